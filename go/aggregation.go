@@ -0,0 +1,178 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the aggregation strategies of the service map.
+const (
+	strategyAllUp           = "all-up"
+	strategyAnyUp           = "any-up"
+	strategyQuorum          = "quorum"
+	strategyWeightedAverage = "weighted-average"
+	strategyPercentageUp    = "percentage-up"
+)
+
+// aggregationStrategies are the strategies accepted in the service map, all-up being the default.
+var aggregationStrategies = []string{strategyAllUp, strategyAnyUp, strategyQuorum, strategyWeightedAverage, strategyPercentageUp}
+
+// aggregationConfig selects how the endpoints of a type, or the types of a product, are combined.
+type aggregationConfig struct {
+	Strategy string `json:"strategy"`
+	// Quorum is the number of components that must be up with the quorum strategy
+	Quorum int `json:"quorum,omitempty"`
+	// Percentage is the percentage of components that must be up with the percentage-up strategy
+	Percentage float64 `json:"percentage,omitempty"`
+	// Threshold is the weighted average from which the level counts as up with the weighted-average strategy, 1 if not set
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// weightedValue is the service availability of a component (endpoint or type) and its weight.
+type weightedValue struct {
+	Value  float64
+	Weight float64
+}
+
+// aggregationStrategy combines the service availability of the components of a level into one value.
+type aggregationStrategy interface {
+	Aggregate(values []weightedValue, kind string) float64
+}
+
+// newAggregationStrategy returns the strategy selected by config, all-up with the given
+// degraded propagation rule if none is.
+func newAggregationStrategy(config aggregationConfig, propagation string) aggregationStrategy {
+	switch config.Strategy {
+	case strategyAnyUp:
+		return anyUp{}
+	case strategyQuorum:
+		return quorum{min: config.Quorum}
+	case strategyWeightedAverage:
+		return weightedAverage{}
+	case strategyPercentageUp:
+		return percentageUp{min: config.Percentage}
+	}
+	return allUp{propagation: propagation}
+}
+
+// allUp is the zero always wins strategy: down if any component is down.
+type allUp struct {
+	propagation string
+}
+
+func (s allUp) Aggregate(values []weightedValue, kind string) float64 {
+	return WorstState(valuesOf(values), s.propagation, kind)
+}
+
+// anyUp is the state of the best component, for redundant components.
+type anyUp struct{}
+
+func (anyUp) Aggregate(values []weightedValue, kind string) float64 {
+	result := saDown
+	for _, value := range values {
+		if value.Value > result {
+			result = value.Value
+		}
+	}
+	if result <= saDown {
+		log.Info("SA DOWN for ", kind, " , none is up")
+	}
+	return result
+}
+
+// quorum is up if at least min components are up, degraded if the degraded ones are needed to reach it.
+type quorum struct {
+	min int
+}
+
+func (s quorum) Aggregate(values []weightedValue, kind string) float64 {
+	upCount, degradedCount := 0, 0
+	for _, value := range values {
+		if value.Value >= saUp {
+			upCount++
+		} else if value.Value > saDown {
+			degradedCount++
+		}
+	}
+	if upCount >= s.min {
+		return saUp
+	}
+	if upCount+degradedCount >= s.min {
+		log.Info("SA DEGRADED for ", kind, " , quorum reached with degraded components")
+		return saDegraded
+	}
+	log.Info("SA DOWN for ", kind, " , ", upCount, " up, quorum of ", s.min, " not reached")
+	return saDown
+}
+
+// weightedAverage is the average of the components weighted by their weight, any value between 0 and 1.
+// ThresholdState gives its state.
+type weightedAverage struct{}
+
+func (weightedAverage) Aggregate(values []weightedValue, kind string) float64 {
+	sum, weights := 0.0, 0.0
+	for _, value := range values {
+		sum += value.Value * value.Weight
+		weights += value.Weight
+	}
+	if weights == 0 {
+		log.Info("SA DOWN for ", kind, " , no weight")
+		return saDown
+	}
+	return sum / weights
+}
+
+// percentageUp is up if at least min percent of the components are up.
+type percentageUp struct {
+	min float64
+}
+
+func (s percentageUp) Aggregate(values []weightedValue, kind string) float64 {
+	if len(values) == 0 {
+		return saDown
+	}
+	upCount := 0
+	for _, value := range values {
+		if value.Value >= saUp {
+			upCount++
+		}
+	}
+	percentage := 100 * float64(upCount) / float64(len(values))
+	if percentage < s.min {
+		log.Info("SA DOWN for ", kind, " , ", percentage, "% up")
+		return saDown
+	}
+	return saUp
+}
+
+// ThresholdState maps the value of a level to the up, degraded and down states: up if it reaches threshold
+// (1 if not set), down if it is 0, degraded otherwise. Without the degraded state, a value below the threshold is down,
+// like with zero always wins. Only the weighted-average strategy gives values other than 0, 0.5 and 1.
+func ThresholdState(value float64, threshold float64, degradedEnabled bool) float64 {
+	if threshold == 0 {
+		threshold = saUp
+	}
+	switch {
+	case value >= threshold:
+		return saUp
+	case value <= saDown || !degradedEnabled:
+		return saDown
+	}
+	return saDegraded
+}
+
+// valuesOf returns the values without their weight.
+func valuesOf(values []weightedValue) []float64 {
+	result := make([]float64, 0, len(values))
+	for _, value := range values {
+		result = append(result, value.Value)
+	}
+	return result
+}
+
+// weightOrDefault returns the weight of a component, 1 if it is not set.
+func weightOrDefault(weight float64) float64 {
+	if weight == 0 {
+		return 1.0
+	}
+	return weight
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources of the availability of an endpoint, kubernetes being the default.
+const (
+	sourceKubernetes = "kubernetes"
+	sourceBlackbox   = "blackbox"
+)
+
+// serviceSources are the sources accepted in the service map.
+var serviceSources = []string{sourceKubernetes, sourceEndpointSlice, sourceBlackbox, sourcePromQL, sourceDeployment, sourceStatefulSet, sourceDaemonSet}
+
+// defaultBlackboxTargetLabel is the label of probe_success matched by the blackbox endpoints
+const defaultBlackboxTargetLabel = "instance"
+
+// GroupEndpointsBySource groups endpoints sharing the same source, defaultSource (kubernetes if empty) if not set.
+func GroupEndpointsBySource(endpoints []serviceEndpoint, defaultSource string) map[string][]serviceEndpoint {
+	if defaultSource == "" {
+		defaultSource = sourceKubernetes
+	}
+	result := make(map[string][]serviceEndpoint)
+	for _, endpoint := range endpoints {
+		source := endpoint.Source
+		if source == "" {
+			source = defaultSource
+		}
+		result[source] = append(result[source], endpoint)
+	}
+	return result
+}
+
+// GetMetricSaBlackboxScope retrieves service availability metrics from the probe_success of a blackbox_exporter
+// for the endpoints of a type sharing the same scope, the endpoints matching the target label of the probes.
+func (e *Exporter) GetMetricSaBlackboxScope(typeEndpoint string, aggr string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	_, mapKeyEndpoint := e.ServicesMaps()
+	var result []ProductTypeEndpointValue
+	label := e.blackboxTargetLabel
+	if label == "" {
+		label = defaultBlackboxTargetLabel
+	}
+
+	//a target is up if every probe of it succeeded at least once during the window, like an address seen ready once
+	mapTargetSuccess := make(map[string]float64)
+	query := BuildBlackboxQuery(label, BuildSelector(label, scope, endpoints), aggr)
+	data, err := e.prom.Query(query)
+	if err != nil {
+		log.Error("PromQL query wrong for ", query)
+		return nil
+	}
+	log.Info("GetMetricSaBlackboxScope query : ", query)
+	for _, elem := range data.(model.Vector) {
+		mapTargetSuccess[string(elem.Metric[model.LabelName(label)])] = float64(elem.Value)
+	}
+
+	for target, value := range mapTargetSuccess {
+		readyValue := ReadyValue(value)
+		if readyValue < 1.0 {
+			log.Info("SA DOWN for blackbox target : ", target)
+		}
+		for _, product := range FindProductsInEndpoints(target, endpoints, mapKeyEndpoint) {
+			configured := FindConfiguredEndpoint(target, product, endpoints, mapKeyEndpoint)
+			result = append(result, ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: target, Namespace: scope.Namespace, Cluster: scope.Cluster, Value: readyValue, Weight: weightOrDefault(configured.Weight), Optional: configured.Optional, Source: sourceBlackbox})
+		}
+	}
+
+	for _, endpoint := range FindMissingEndpoints(endpoints, mapTargetSuccess) {
+		log.Info("SA MISSING for blackbox target : ", endpoint.Name, " , no probe_success series")
+		for _, product := range mapKeyEndpoint[endpoint] {
+			result = append(result, ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: endpoint.Name, Namespace: scope.Namespace, Cluster: scope.Cluster, Value: 0.0, Weight: weightOrDefault(endpoint.Weight), Optional: endpoint.Optional, Source: sourceBlackbox, Missing: true})
+		}
+	}
+	return result
+}
+
+// BuildBlackboxQuery builds the PromQL query returning by target the worst of the probe_success series matching selector,
+// each one being first reduced over the aggr lookback window.
+func BuildBlackboxQuery(label string, selector string, aggr string) string {
+	return "min by (" + label + ")(" + overWindow("probe_success{"+selector+"}", aggr) + ")"
+}
+
+// FindProductsInEndpoints returns the products of the endpoints matching the endpoint found in Prometheus.
+func FindProductsInEndpoints(endpointToTest string, endpoints []serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string) []string {
+	var result []string
+	for _, endpoint := range endpoints {
+		if !anchoredRegex(endpoint.Name).MatchString(endpointToTest) {
+			continue
+		}
+		for _, product := range mapKeyEndpoint[endpoint] {
+			if !containsString(result, product) {
+				result = append(result, product)
+			}
+		}
+	}
+	return result
+}
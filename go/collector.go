@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,55 +19,235 @@ var (
 
 	metricSaInternal = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "service"),
-		"Internal Service Availability 1m for interactive, 5m for batch",
-		[]string{"product", "type", "endpoint"}, nil,
+		"Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)",
+		[]string{"product", "type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricSaMissing = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_missing"),
+		"Whether a configured endpoint has no series from its source, deleted or misspelled service",
+		[]string{"product", "type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricAddressesReady = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "endpoint", "addresses_ready"),
+		"Number of ready addresses of an endpoint, aggr on the window of its type",
+		[]string{"type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricAddressesTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "endpoint", "addresses_total"),
+		"Number of addresses, ready or not, of an endpoint, aggr on the window of its type",
+		[]string{"type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricAddressesTerminating = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "endpoint", "addresses_terminating"),
+		"Number of serving but terminating addresses of an endpoint of the endpointslice source, aggr on the window of its type",
+		[]string{"type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricProbeSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "success"),
+		"Whether the active probe of an endpoint was successful",
+		[]string{"product", "type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricProbeDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "duration_seconds"),
+		"Duration of the active probe of an endpoint",
+		[]string{"product", "type", "endpoint", "namespace", "cluster"}, nil,
+	)
+
+	metricUnmappedEndpoint = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "unmapped_endpoint"),
+		"Kubernetes endpoint not mapped to any product",
+		[]string{"namespace", "endpoint"}, nil,
 	)
 
 	metricSaType = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "service_type"),
-		"Interactive or Batch Service Availability aggr 1m or 5m respectively",
-		[]string{"product", "type"}, nil,
+		"Service Availability per type (interactive, batch or custom types) aggr on the window of the type",
+		[]string{"product", "type", "namespace", "cluster"}, nil,
 	)
 
 	metricSaOverall = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "service_overall"),
 		"Overall Service Availability aggr",
-		[]string{"product"}, nil,
+		[]string{"product", "namespace", "cluster"}, nil,
+	)
+
+	metricSaEffective = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_effective"),
+		"Overall Service Availability lowered by the one of the products depended on, down if any hard dependency is down",
+		[]string{"product", "namespace", "cluster"}, nil,
+	)
+
+	metricSaState = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "service_state"),
+		"Overall Service Availability state of the product, 1 for its current state among up, degraded and down",
+		[]string{"product", "namespace", "cluster", "state"}, nil,
+	)
+
+	configLastReloadSuccessful = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "config", "last_reload_successful"),
+		"Whether the last service map reload attempt was successful",
+		nil, nil,
+	)
+
+	configLastReloadTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "config", "last_reload_timestamp_seconds"),
+		"Timestamp of the last service map reload attempt",
+		nil, nil,
+	)
+
+	evaluationTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_evaluation_timestamp_seconds"),
+		"Timestamp of the last evaluation of the SA, 0 before the first one",
+		nil, nil,
+	)
+
+	evaluationDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "evaluation_duration_seconds"),
+		"Duration of the last evaluation of the SA",
+		nil, nil,
 	)
 )
 
 // Exporter collects Mon metrics. It implements prometheus.Collector interface.
 type Exporter struct {
-	promURL, saInteractiveAggr, saBatchAggr string
-	mapKeyType                              map[string][]string
-	mapKeyEndpoint                          map[string][]string
+	// prom is the long-lived client of Prometheus
+	prom promAPI
+	// typesAggr is the aggregation window of every service type
+	typesAggr map[string]string
+	// mutex protects the service maps and the reload status, swapped on reload
+	mutex                sync.RWMutex
+	mapKeyType           map[string][]serviceEndpoint
+	mapKeyEndpoint       map[serviceEndpoint][]string
+	productsConfig       map[string]productConfig
+	lastReloadSuccessful bool
+	lastReloadTimestamp  time.Time
+	// missingAsDown reports the configured endpoints without series in sa_service with a SA of 0
+	missingAsDown bool
+	// unmappedEnabled reports the Kubernetes endpoints, of the namespaces matching unmappedNamespace, not mapped to any product
+	unmappedEnabled   bool
+	unmappedNamespace string
+	// blackboxTargetLabel is the label of probe_success matched by the endpoints of the blackbox source
+	blackboxTargetLabel string
+	// degradedEnabled reports the endpoints with ready addresses below their threshold as degraded (0.5) instead of down,
+	// degradedPropagation telling how a degraded endpoint or type is propagated to the upper level
+	degradedEnabled     bool
+	degradedPropagation string
+	// defaultSource is the source of the endpoints without one, kubernetes if empty
+	defaultSource string
+	// backgroundEvaluation serves the last snapshot evaluated in background instead of evaluating the SA at every scrape
+	backgroundEvaluation bool
+	lastEvaluation       evaluation
+	// kubeWatcher is the cache of the Kubernetes API giving the addresses of the services, Prometheus being used if nil
+	kubeWatcher *kubeWatcher
+	// servicesMutex serializes the merges of the static service map with the discovered services
+	servicesMutex   sync.Mutex
+	staticServices  []services
+	discovered      []discoveredService
+	discoveryStatus discoveryStatus
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(promURL string, mapKeyType map[string][]string, mapKeyEndpoint map[string][]string, saInteractiveAggr string, saBatchAggr string) *Exporter {
+// NewExporter returns an initialized Exporter querying Prometheus with prom.
+func NewExporter(prom promAPI, mapKeyType map[string][]serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string, typesAggr map[string]string) *Exporter {
+	compileAnchoredPatterns(mapKeyType)
 	return &Exporter{
-		promURL:           promURL,
-		mapKeyType:        mapKeyType,
-		mapKeyEndpoint:    mapKeyEndpoint,
-		saInteractiveAggr: saInteractiveAggr,
-		saBatchAggr:       saBatchAggr,
+		prom:           prom,
+		mapKeyType:     mapKeyType,
+		mapKeyEndpoint: mapKeyEndpoint,
+		typesAggr:      typesAggr,
 	}
 }
 
+// ServicesMaps returns the service maps currently in use.
+func (e *Exporter) ServicesMaps() (map[string][]serviceEndpoint, map[serviceEndpoint][]string) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.mapKeyType, e.mapKeyEndpoint
+}
+
+// SetProductsConfig swaps the aggregation strategies and weights of the products.
+func (e *Exporter) SetProductsConfig(productsConfig map[string]productConfig) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.productsConfig = productsConfig
+}
+
+// ProductsConfig returns the aggregation strategies and weights of the products currently in use.
+func (e *Exporter) ProductsConfig() map[string]productConfig {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.productsConfig
+}
+
+// setReloadStatus records the result of a service map (re)load attempt.
+func (e *Exporter) setReloadStatus(successful bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastReloadSuccessful = successful
+	e.lastReloadTimestamp = time.Now()
+}
+
 // Describe describes all the metrics ever exported by the Mon exporter. It
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- up
 	ch <- metricSaInternal
+	ch <- metricSaMissing
+	ch <- metricAddressesReady
+	ch <- metricAddressesTotal
+	ch <- metricAddressesTerminating
+	ch <- metricProbeSuccess
+	ch <- metricProbeDuration
+	ch <- metricUnmappedEndpoint
 	ch <- metricSaType
 	ch <- metricSaOverall
+	ch <- metricSaEffective
+	ch <- metricSaState
+	ch <- configLastReloadSuccessful
+	ch <- configLastReloadTimestamp
+	ch <- evaluationTimestamp
+	ch <- evaluationDuration
 }
 
 // Collect fetches the stats from configured Mon location and delivers them
 // as Prometheus metrics. It implements prometheus.Collector.
+// In background mode the last snapshot is served instead of evaluating the SA.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	startProm := time.Now()
-	e.CollectPromMetrics(ch)
+	e.CollectConfigMetrics(ch)
+	var last evaluation
+	if e.backgroundEvaluation {
+		last = e.LastEvaluation()
+	} else {
+		last = e.Evaluate()
+	}
+	for _, metric := range last.metrics {
+		ch <- metric
+	}
+	CollectEvaluationMetrics(ch, last)
 	end := time.Now()
 	log.Info("Collect finished in ", end.Sub(startProm))
 }
+
+// CollectConfigMetrics sends the status of the last service map reload.
+func (e *Exporter) CollectConfigMetrics(ch chan<- prometheus.Metric) {
+	e.mutex.RLock()
+	successful := 0.0
+	if e.lastReloadSuccessful {
+		successful = 1.0
+	}
+	timestamp := e.lastReloadTimestamp
+	e.mutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(
+		configLastReloadSuccessful, prometheus.GaugeValue, successful,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		configLastReloadTimestamp, prometheus.GaugeValue, float64(timestamp.Unix()),
+	)
+}
@@ -1,20 +1,48 @@
 package main
 
 import (
-	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 )
 
+// Service availability values, degraded being only used if the degraded state is enabled.
+const (
+	saDown     = 0.0
+	saDegraded = 0.5
+	saUp       = 1.0
+)
+
+// Propagation rules of a degraded type or endpoint to the upper level.
+const (
+	propagateDegraded = "degraded"
+	propagateDown     = "down"
+	propagateUp       = "up"
+)
+
 // ProductTypeEndpointValue represents a service availability metric for a specific product, type, and endpoint.
 type ProductTypeEndpointValue struct {
-	Product  string
-	Type     string
-	Endpoint string
-	Value    float64
+	Product   string
+	Type      string
+	Endpoint  string
+	Namespace string
+	Cluster   string
+	Value     float64
+	// Weight is the weight of the endpoint in its type, 1 if not set
+	Weight float64
+	// Optional is set for an endpoint that can not make its type down
+	Optional bool
+	// Source is where the availability comes from, kubernetes if empty
+	Source string
+	// Ready and Total are the number of ready and of all the addresses of the endpoint on the window
+	Ready float64
+	Total float64
+	// Terminating is the number of serving but terminating addresses, EndpointSlice source only
+	Terminating float64
+	// Missing is set for a configured endpoint without any series, Endpoint being then its configured name
+	Missing bool
 }
 
 // CollectPromMetrics collects Prometheus metrics and sends them to the provided channel.
@@ -32,11 +60,14 @@ func (e *Exporter) CollectPromMetrics(ch chan<- prometheus.Metric) {
 	)
 
 	e.HitProm(ch)
+	if e.unmappedEnabled {
+		e.CollectUnmappedEndpoints(ch)
+	}
 }
 
 // TestProm tests connectivity to Prometheus server.
 func (e *Exporter) TestProm() error {
-	_, err := PromQuery(e.promURL, "up{job=\"prometheus\"}")
+	_, err := e.prom.Query("up{job=\"prometheus\"}")
 
 	if err != nil {
 		log.Error("Prometheus dependancy NOK")
@@ -50,48 +81,132 @@ func (e *Exporter) TestProm() error {
 // https://godoc.org/github.com/prometheus/common/model#Vector
 // https://godoc.org/github.com/prometheus/client_golang/api/prometheus/v1
 func (e *Exporter) HitProm(ch chan<- prometheus.Metric) {
+	mapKeyType, mapKeyEndpoint := e.ServicesMaps()
+	productsConfig := e.ProductsConfig()
 
-	//sa_internal interactive
-	saInternalInteractive := e.GetMetricSaInternal("interactive", e.saInteractiveAggr)
-	for _, elem := range saInternalInteractive {
-		ch <- prometheus.MustNewConstMetric(
-			metricSaInternal, prometheus.GaugeValue, elem.Value, elem.Product, elem.Type, elem.Endpoint,
-		)
+	//sa_internal for every type, each one with its own aggregation window
+	saInternal := make(map[string][]ProductTypeEndpointValue)
+	for _, typeEndpoint := range sortedTypes(e.typesAggr) {
+		values := e.GetMetricSaInternal(typeEndpoint, e.typesAggr[typeEndpoint])
+		CollectEndpointAddresses(ch, values)
+		//the active probes are combined with the readiness of their endpoint
+		probes := RunProbes(mapKeyType[typeEndpoint])
+		CollectProbes(ch, typeEndpoint, probes, mapKeyEndpoint)
+		CombineProbes(values, mapKeyType[typeEndpoint], probes, mapKeyEndpoint)
+		for _, elem := range values {
+			//missing endpoints only count as outages if the policy says so
+			if elem.Missing && !e.missingAsDown {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				metricSaInternal, prometheus.GaugeValue, elem.Value, elem.Product, elem.Type, elem.Endpoint, elem.Namespace, elem.Cluster,
+			)
+			saInternal[typeEndpoint] = append(saInternal[typeEndpoint], elem)
+		}
+		e.CollectMissingEndpoints(ch, typeEndpoint, values, mapKeyType, mapKeyEndpoint)
 	}
 
-	//sa_internal batch
-	saInternalBatch := e.GetMetricSaInternal("batch", e.saBatchAggr)
-	for _, elem := range saInternalBatch {
+	//BY PRODUCT Metrics
+	//find all unique products from the service map, so that a product without data still gets its aggr metrics
+	products := FindProductsFromServicesMap(mapKeyEndpoint)
+	saOveralls := make(map[string]float64)
+	saOverallScopes := make(map[string]serviceScope)
+	for product := range products {
+		log.Info("Will compute SA aggr metrics for product : ", product)
+		//sa_type for every type declared by the product, with the aggregation strategy of the type
+		config := productsConfig[product]
+		var saTypes []weightedValue
+		for _, typeEndpoint := range FindTypesForProduct(product, mapKeyType, mapKeyEndpoint) {
+			saTypeScope := FindScopeForProduct(product, typeEndpoint, mapKeyType, mapKeyEndpoint)
+			strategy := newAggregationStrategy(config.types[typeEndpoint].aggregation, e.degradedPropagation)
+			saType := SaTypeValue(ExtractWeightedValues(product, saInternal[typeEndpoint], e.optionalFloor()), strategy, product+" "+typeEndpoint)
+			ch <- prometheus.MustNewConstMetric(
+				metricSaType, prometheus.GaugeValue, saType, product, typeEndpoint, saTypeScope.Namespace, saTypeScope.Cluster,
+			)
+			//the product sees the state of the type, a weighted average being mapped by its threshold
+			saTypeState := ThresholdState(saType, config.types[typeEndpoint].aggregation.Threshold, e.degradedEnabled)
+			saTypes = append(saTypes, weightedValue{Value: saTypeState, Weight: weightOrDefault(config.types[typeEndpoint].weight)})
+		}
+		//sa_overall, with the overall aggregation strategy of the product
+		saOverallScope := FindScopeForProduct(product, "", mapKeyType, mapKeyEndpoint)
+		saOverall := newAggregationStrategy(config.aggregation, e.degradedPropagation).Aggregate(saTypes, product+" overall")
+		//the dependent products see the state of the product, a weighted average being mapped by its threshold
+		saOveralls[product] = ThresholdState(saOverall, config.aggregation.Threshold, e.degradedEnabled)
+		saOverallScopes[product] = saOverallScope
 		ch <- prometheus.MustNewConstMetric(
-			metricSaInternal, prometheus.GaugeValue, elem.Value, elem.Product, elem.Type, elem.Endpoint,
+			metricSaOverall, prometheus.GaugeValue, saOverall, product, saOverallScope.Namespace, saOverallScope.Cluster,
 		)
+		//sa_service_state, one series per state, the one of the product being set to 1
+		saState := StateName(saOveralls[product])
+		for _, state := range []float64{saUp, saDegraded, saDown} {
+			value := 0.0
+			if StateName(state) == saState {
+				value = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(
+				metricSaState, prometheus.GaugeValue, value, product, saOverallScope.Namespace, saOverallScope.Cluster, StateName(state),
+			)
+		}
 	}
 
-	//BY PRODUCT Metrics
-	//find all unique products from batch list
-	products := FindProductsFromQueryResult(saInternalBatch)
-	for product := range products {
-		log.Info("Will compute SA aggr metrics for product : ", product)
-		//sa_interactive
-		saInteractiveLabel := "interactive"
-		saInteractive := ZeroAlwaysWin(ExtractValues(product, saInternalInteractive), product+" "+saInteractiveLabel)
+	//sa_effective, the overall SA lowered by the one of the products depended on
+	for product, saEffective := range EffectiveValues(saOveralls, dependencyGraphOf(productsConfig), e.optionalFloor()) {
 		ch <- prometheus.MustNewConstMetric(
-			metricSaType, prometheus.GaugeValue, saInteractive, product, saInteractiveLabel,
+			metricSaEffective, prometheus.GaugeValue, saEffective, product, saOverallScopes[product].Namespace, saOverallScopes[product].Cluster,
 		)
-		//sa_batch
-		saBatchLabel := "batch"
-		saBatch := ZeroAlwaysWin(ExtractValues(product, saInternalBatch), product+" "+saBatchLabel)
+	}
+
+	log.Debug("Endpoint scraped")
+}
+
+// CollectMissingEndpoints sends sa_service_missing for every configured endpoint of a type,
+// 1 if it has no series, 0 otherwise.
+func (e *Exporter) CollectMissingEndpoints(ch chan<- prometheus.Metric, typeEndpoint string, values []ProductTypeEndpointValue, mapKeyType map[string][]serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string) {
+	missing := make(map[ProductTypeEndpointValue]bool)
+	for _, elem := range values {
+		if elem.Missing {
+			missing[ProductTypeEndpointValue{Product: elem.Product, Type: elem.Type, Endpoint: elem.Endpoint, Namespace: elem.Namespace, Cluster: elem.Cluster}] = true
+		}
+	}
+	for _, endpoint := range mapKeyType[typeEndpoint] {
+		for _, product := range mapKeyEndpoint[endpoint] {
+			value := 0.0
+			if missing[ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: endpoint.Name, Namespace: endpoint.Namespace, Cluster: endpoint.Cluster}] {
+				value = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(
+				metricSaMissing, prometheus.GaugeValue, value, product, typeEndpoint, endpoint.Name, endpoint.Namespace, endpoint.Cluster,
+			)
+		}
+	}
+}
+
+// CollectEndpointAddresses sends the number of ready and of all the addresses of every endpoint found,
+// once per endpoint whatever the number of products it belongs to.
+func CollectEndpointAddresses(ch chan<- prometheus.Metric, values []ProductTypeEndpointValue) {
+	sent := make(map[ProductTypeEndpointValue]bool)
+	for _, elem := range values {
+		//only the Kubernetes services have addresses
+		if elem.Missing || !IsServiceSource(elem.Source) {
+			continue
+		}
+		key := ProductTypeEndpointValue{Type: elem.Type, Endpoint: elem.Endpoint, Namespace: elem.Namespace, Cluster: elem.Cluster}
+		if sent[key] {
+			continue
+		}
+		sent[key] = true
 		ch <- prometheus.MustNewConstMetric(
-			metricSaType, prometheus.GaugeValue, saBatch, product, saBatchLabel,
+			metricAddressesReady, prometheus.GaugeValue, elem.Ready, elem.Type, elem.Endpoint, elem.Namespace, elem.Cluster,
 		)
-		//sa_overall
-		saOverall := ZeroAlwaysWin([]float64{saInteractive, saBatch}, product+" overall")
 		ch <- prometheus.MustNewConstMetric(
-			metricSaOverall, prometheus.GaugeValue, saOverall, product,
+			metricAddressesTotal, prometheus.GaugeValue, elem.Total, elem.Type, elem.Endpoint, elem.Namespace, elem.Cluster,
 		)
+		if elem.Source == sourceEndpointSlice {
+			ch <- prometheus.MustNewConstMetric(
+				metricAddressesTerminating, prometheus.GaugeValue, elem.Terminating, elem.Type, elem.Endpoint, elem.Namespace, elem.Cluster,
+			)
+		}
 	}
-
-	log.Debug("Endpoint scraped")
 }
 
 // GetMetricSaInternal retrieves service availability metrics for internal endpoints of a specific type.
@@ -103,87 +218,182 @@ func (e *Exporter) GetMetricSaInternal(typeEndpoint string, aggr string) []Produ
 	//NEW Feb 2025
 	//kube_endpoint_address_available was deprecated in 2.5.0 then removed in 2.14.0
 	//kube_endpoint_address is the new metric to use
+	//one query per source and scope so that the namespace and cluster selectors are pushed into the label matchers
+	mapKeyType, _ := e.ServicesMaps()
 	var result []ProductTypeEndpointValue
-	queryEndpoints := BuildSaQueryEndpoints(typeEndpoint, e.mapKeyType)
-
-	//1. find the total number of addresses ready or not
-	mapEndpointAvail := make(map[string]float64)
-	queryAllAdressSvc := "sum by (endpoint)(kube_endpoint_address{endpoint=~\"" + queryEndpoints + "\"})"
-	dataAllAdressSvc, err := PromQuery(e.promURL, queryAllAdressSvc)
-	if err != nil {
-		log.Error("PromQL query wrong for ", queryAllAdressSvc)
-	} else {
-		log.Info("GetMetricSaInternal query : ", queryAllAdressSvc)
-		vectorVal := dataAllAdressSvc.(model.Vector)
-		for _, elem := range vectorVal {
-			endpoint := elem.Metric["endpoint"]
-			mapEndpointAvail[string(endpoint)] = float64(elem.Value)
+	for source, sourceEndpoints := range GroupEndpointsBySource(mapKeyType[typeEndpoint], e.defaultSource) {
+		for scope, endpoints := range GroupEndpointsByScope(sourceEndpoints) {
+			//the addresses of the services come from the Kubernetes API when it is watched
+			if e.kubeWatcher != nil && IsServiceSource(source) {
+				result = append(result, e.GetMetricSaKubeScope(typeEndpoint, source, scope, endpoints)...)
+				continue
+			}
+			switch source {
+			case sourceBlackbox:
+				result = append(result, e.GetMetricSaBlackboxScope(typeEndpoint, aggr, scope, endpoints)...)
+			case sourcePromQL:
+				result = append(result, e.GetMetricSaExpressionScope(typeEndpoint, aggr, scope, endpoints)...)
+			case sourceEndpointSlice:
+				result = append(result, e.GetMetricSaEndpointSliceScope(typeEndpoint, aggr, scope, endpoints)...)
+			case sourceDeployment, sourceStatefulSet, sourceDaemonSet:
+				result = append(result, e.GetMetricSaWorkloadScope(source, typeEndpoint, aggr, scope, endpoints)...)
+			default:
+				result = append(result, e.GetMetricSaInternalScope(typeEndpoint, aggr, scope, endpoints)...)
+			}
 		}
 	}
+	return result
+}
 
-	//2. find the total number of addresses not ready and substract it from the total
-	queryNotReadyAddressSvc := "sum by (endpoint)(kube_endpoint_address{endpoint=~\"" + queryEndpoints + "\",ready=\"false\"})"
-	dataNotReadyAddressSvc, err := PromQuery(e.promURL, queryNotReadyAddressSvc)
+// GetMetricSaInternalScope retrieves service availability metrics for the endpoints of a type sharing the same scope.
+func (e *Exporter) GetMetricSaInternalScope(typeEndpoint string, aggr string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	//1. find the total number of addresses ready or not, and the ones seen ready during the window.
+	//kube_endpoint_address is always 1, the max over the window keeps every series seen during the window,
+	//so a missed scrape does not flip the SA. An address changing of ready state has one series per state,
+	//so the addresses are counted by ip and not by series.
+	selector := BuildSaSelector(scope, endpoints)
+	total, err := e.QueryEndpointValues("endpoint", BuildSaQuery(selector, aggr))
 	if err != nil {
-		log.Error("PromQL query wrong for ", queryNotReadyAddressSvc)
-	} else {
-		vectorVal := dataNotReadyAddressSvc.(model.Vector)
-		for _, elem := range vectorVal {
-			endpoint := elem.Metric["endpoint"]
-			if _, ok := mapEndpointAvail[string(endpoint)]; !ok {
-				log.Error("Endpoint not found in mapEndpointAvail, synch issue !: ", string(endpoint))
-				continue
-			}
-			mapEndpointAvail[string(endpoint)] = mapEndpointAvail[string(endpoint)] - float64(elem.Value)
-		}
+		return nil
+	}
+	ready, err := e.QueryEndpointValues("endpoint", BuildSaQuery(selector+",ready=\"true\"", aggr))
+	if err != nil {
+		return nil
+	}
+	addresses := make(map[string]endpointAddresses)
+	for endpoint, count := range total {
+		addresses[endpoint] = endpointAddresses{Ready: ready[endpoint], Total: count}
 	}
 
-	//3. find the total number of addresses available (ie total- not ready)
-	//if total == 0 => SA == 0
-	//if total > 0 => SA == 1
-	for endpoint, value := range mapEndpointAvail {
-		readyValue := ReadyValue(value)
-		if readyValue < 1.0 {
-			log.Info("SA DOWN for endpoint : ", endpoint, " , #address_available : ", value)
-		}
+	//2. apply the ready threshold of the endpoints, a single address being enough by default
+	return e.AddressesValues(typeEndpoint, scope, endpoints, sourceKubernetes, addresses, "no kube_endpoint_address series")
+}
 
-		// it is possible to have multiple products
-		products := FindProductsForEndpoint(endpoint, e.mapKeyEndpoint)
-		for _, product := range products {
-			result = append(result, ProductTypeEndpointValue{product, typeEndpoint, endpoint, readyValue})
-		}
+// BuildSaQuery builds the PromQL query counting by endpoint the distinct addresses of the kube_endpoint_address
+// series matching selector, seen during the aggr lookback window.
+func BuildSaQuery(selector string, aggr string) string {
+	return "count by (endpoint)(count by (cluster, namespace, endpoint, ip)(" + overWindow("kube_endpoint_address{"+selector+"}", aggr) + "))"
+}
+
+// overWindow reduces series with max_over_time on the aggr lookback window, so that a series seen once
+// during the window is kept. An empty aggr gives an instant query.
+func overWindow(series string, aggr string) string {
+	if aggr == "" {
+		return series
 	}
+	return "max_over_time(" + series + "[" + aggr + "])"
+}
 
+// GroupEndpointsByScope groups endpoints sharing the same namespace and cluster selectors.
+func GroupEndpointsByScope(endpoints []serviceEndpoint) map[serviceScope][]serviceEndpoint {
+	result := make(map[serviceScope][]serviceEndpoint)
+	for _, endpoint := range endpoints {
+		result[endpoint.serviceScope] = append(result[endpoint.serviceScope], endpoint)
+	}
 	return result
 }
 
-// BuildSaQueryEndpoints builds a pipe-separated string of endpoints for the given type.
-func BuildSaQueryEndpoints(typeEndpoint string, mapKeyType map[string][]string) string {
+// BuildSaSelector builds the label matchers selecting the endpoints in the given scope.
+func BuildSaSelector(scope serviceScope, endpoints []serviceEndpoint) string {
+	return BuildSelector("endpoint", scope, endpoints)
+}
+
+// BuildSelector builds the label matchers selecting the endpoints on the given label in the given scope.
+func BuildSelector(label string, scope serviceScope, endpoints []serviceEndpoint) string {
+	return label + "=~\"" + BuildSaQueryEndpoints(endpoints) + "\"" + BuildScopeSelector(scope)
+}
+
+// BuildScopeSelector builds the label matchers of the namespace and cluster of the scope, each one preceded by a comma.
+func BuildScopeSelector(scope serviceScope) string {
+	selector := ""
+	if scope.Namespace != "" {
+		selector += ",namespace=~\"" + scope.Namespace + "\""
+	}
+	if scope.Cluster != "" {
+		selector += ",cluster=~\"" + scope.Cluster + "\""
+	}
+	return selector
+}
+
+// BuildSaQueryEndpoints builds a pipe-separated string of endpoint names.
+func BuildSaQueryEndpoints(endpoints []serviceEndpoint) string {
 	var result strings.Builder
-	endpoints := mapKeyType[typeEndpoint]
 	for i := 0; i < len(endpoints); i++ {
-		result.WriteString(endpoints[i])
+		result.WriteString(endpoints[i].Name)
 		result.WriteString("|")
 	}
 	return result.String()
 }
 
-// FindProductsForEndpoint finds all products associated with a given endpoint using regex matching.
-func FindProductsForEndpoint(endpointToTest string, mapKeyEndpoint map[string][]string) []string {
-	//a map here is of no help unfortunately
+// FindScopeForProduct returns the namespace and cluster selectors shared by the endpoints of a product
+// for the given type, or for all types if typeEndpoint is empty. A selector differing between endpoints is left empty.
+func FindScopeForProduct(product string, typeEndpoint string, mapKeyType map[string][]serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string) serviceScope {
+	var result serviceScope
+	first := true
+	for t, endpoints := range mapKeyType {
+		if typeEndpoint != "" && t != typeEndpoint {
+			continue
+		}
+		for _, endpoint := range endpoints {
+			if !containsString(mapKeyEndpoint[endpoint], product) {
+				continue
+			}
+			if first {
+				result = endpoint.serviceScope
+				first = false
+				continue
+			}
+			if result.Namespace != endpoint.Namespace {
+				result.Namespace = ""
+			}
+			if result.Cluster != endpoint.Cluster {
+				result.Cluster = ""
+			}
+		}
+	}
+	return result
+}
+
+// FindTypesForProduct returns the types declared by a product in the service map, in alphabetical order.
+func FindTypesForProduct(product string, mapKeyType map[string][]serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string) []string {
 	var result []string
-	for endpoint, products := range mapKeyEndpoint {
-		pattern := regexp.MustCompile(endpoint)
-		if pattern.MatchString(endpointToTest) {
-			log.Debug(endpointToTest, " is matching with ", endpoint)
-			return products
+	for typeEndpoint, endpoints := range mapKeyType {
+		for _, endpoint := range endpoints {
+			if containsString(mapKeyEndpoint[endpoint], product) {
+				result = append(result, typeEndpoint)
+				break
+			}
 		}
 	}
+	sort.Strings(result)
+	return result
+}
 
-	if len(result) == 0 {
-		log.Error("Could not found any matches for endpoint " + endpointToTest)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
+	return false
+}
 
+// FindMissingEndpoints returns the configured endpoints not matching any of the endpoints found in Prometheus.
+func FindMissingEndpoints(endpoints []serviceEndpoint, foundEndpoints map[string]float64) []serviceEndpoint {
+	var result []serviceEndpoint
+	for _, endpoint := range endpoints {
+		pattern := anchoredRegex(endpoint.Name)
+		found := false
+		for foundEndpoint := range foundEndpoints {
+			if pattern.MatchString(foundEndpoint) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, endpoint)
+		}
+	}
 	return result
 }
 
@@ -197,6 +407,18 @@ func FindProductsFromQueryResult(productTypeEndpointValue []ProductTypeEndpointV
 	return set
 }
 
+// FindProductsFromServicesMap extracts unique product names from the service map.
+func FindProductsFromServicesMap(mapKeyEndpoint map[serviceEndpoint][]string) map[string]struct{} {
+	var member struct{}
+	set := make(map[string]struct{})
+	for _, products := range mapKeyEndpoint {
+		for _, product := range products {
+			set[product] = member
+		}
+	}
+	return set
+}
+
 // ReadyValue converts a numeric value to a binary ready state (0 or 1).
 func ReadyValue(valueIn float64) float64 {
 	valueOut := 1.0
@@ -207,6 +429,44 @@ func ReadyValue(valueIn float64) float64 {
 	return valueOut
 }
 
+// ThresholdReadyValue converts the number of ready addresses of an endpoint to a binary ready state (0 or 1),
+// 1 if at least the minimum ready count and fraction of the total addresses are ready.
+func ThresholdReadyValue(ready float64, total float64, threshold readyThreshold) float64 {
+	if ReadyValue(ready) == 0.0 || ready < float64(threshold.MinReady) {
+		return 0.0
+	}
+	if threshold.MinReadyRatio > 0 && ready/total < threshold.MinReadyRatio {
+		return 0.0
+	}
+	return 1.0
+}
+
+// ThresholdStateValue converts the number of ready addresses of an endpoint to a tri-state value:
+// up if the threshold is reached, degraded if some addresses are ready but not enough, down if none is ready.
+func ThresholdStateValue(ready float64, total float64, threshold readyThreshold) float64 {
+	if ReadyValue(ready) == 0.0 {
+		return saDown
+	}
+	if ThresholdReadyValue(ready, total, threshold) == 0.0 {
+		return saDegraded
+	}
+	return saUp
+}
+
+// FindConfiguredEndpoint returns the first configured endpoint of the product matching the endpoint found
+// in Prometheus, with its ready threshold and weight.
+func FindConfiguredEndpoint(endpointToTest string, product string, endpoints []serviceEndpoint, mapKeyEndpoint map[serviceEndpoint][]string) serviceEndpoint {
+	for _, endpoint := range endpoints {
+		if !containsString(mapKeyEndpoint[endpoint], product) {
+			continue
+		}
+		if anchoredRegex(endpoint.Name).MatchString(endpointToTest) {
+			return endpoint
+		}
+	}
+	return serviceEndpoint{Name: endpointToTest}
+}
+
 // ExtractValues extracts all metric values for a specific product from the query results.
 func ExtractValues(product string, productTypeEndpointValue []ProductTypeEndpointValue) []float64 {
 	var result []float64
@@ -218,6 +478,81 @@ func ExtractValues(product string, productTypeEndpointValue []ProductTypeEndpoin
 	return result
 }
 
+// ExtractWeightedValues extracts all metric values for a specific product from the query results, with their weight.
+// The values of the optional endpoints are raised to optionalFloor, so that they do not make the type down.
+func ExtractWeightedValues(product string, productTypeEndpointValue []ProductTypeEndpointValue, optionalFloor float64) []weightedValue {
+	var result []weightedValue
+	for _, elem := range productTypeEndpointValue {
+		if elem.Product != product {
+			continue
+		}
+		value := elem.Value
+		if elem.Optional && value < optionalFloor {
+			log.Info("SA of optional endpoint ", elem.Endpoint, " of ", product, " raised from ", value, " to ", optionalFloor)
+			value = optionalFloor
+		}
+		result = append(result, weightedValue{Value: value, Weight: elem.Weight})
+	}
+	return result
+}
+
+// optionalFloor is the lowest value an optional endpoint counts for in its type:
+// degraded if the degraded state is enabled, up otherwise.
+func (e *Exporter) optionalFloor() float64 {
+	if e.degradedEnabled {
+		return saDegraded
+	}
+	return saUp
+}
+
+// SaTypeValue aggregates the endpoint values of a product type with the aggregation strategy of the type.
+// A type without any endpoint data is considered as down.
+func SaTypeValue(valuesIn []weightedValue, strategy aggregationStrategy, kind string) float64 {
+	if len(valuesIn) == 0 {
+		log.Info("SA DOWN for ", kind, " , no data for any of its endpoints")
+		return 0.0
+	}
+	return strategy.Aggregate(valuesIn, kind)
+}
+
+// WorstState extends ZeroAlwaysWin to the degraded state: down if any value is down, otherwise
+// degraded values are propagated as degraded, down or up depending on the propagation rule.
+// With binary values, it is the same as ZeroAlwaysWin.
+func WorstState(valuesIn []float64, propagation string, kind string) float64 {
+	result := saUp
+	for _, valueIn := range valuesIn {
+		if valueIn <= saDown {
+			log.Info("SA DOWN for ", kind)
+			return saDown
+		}
+		if valueIn < saUp {
+			result = saDegraded
+		}
+	}
+	if result == saDegraded {
+		switch propagation {
+		case propagateDown:
+			log.Info("SA DOWN for ", kind, " , degraded")
+			return saDown
+		case propagateUp:
+			return saUp
+		}
+		log.Info("SA DEGRADED for ", kind)
+	}
+	return result
+}
+
+// StateName returns the name of a service availability value, as used by sa_service_state.
+func StateName(value float64) string {
+	switch {
+	case value >= saUp:
+		return "up"
+	case value > saDown:
+		return "degraded"
+	}
+	return "down"
+}
+
 // ZeroAlwaysWin implements the "zero always wins" logic for service availability.
 // If any value is less than 1.0, the result is 0.0, otherwise 1.0.
 func ZeroAlwaysWin(valuesIn []float64, kind string) float64 {
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Queries of the services annotated or labelled with sa.product, kube-state-metrics exposing the label
+// and annotation names sanitized and prefixed.
+const (
+	discoveryLabelsQuery      = `kube_service_labels{label_sa_product!=""}`
+	discoveryAnnotationsQuery = `kube_service_annotations{annotation_sa_product!=""}`
+)
+
+// discoveredService is a Kubernetes service mapped to a product by its labels or annotations.
+type discoveredService struct {
+	Product   string `json:"product"`
+	Type      string `json:"type"`
+	Endpoint  string `json:"endpoint"`
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster,omitempty"`
+}
+
+// discoveryStatus is the result of the last discovery, shown on /discovery.
+type discoveryStatus struct {
+	LastRefresh time.Time `json:"last_refresh"`
+	Error       string    `json:"error,omitempty"`
+	// Discovered are the services merged with the static service map
+	Discovered []discoveredService `json:"discovered"`
+	// Overridden are the services already mapped by the static service map, which wins
+	Overridden []discoveredService `json:"overridden"`
+}
+
+// DiscoverServices returns the services having a sa.product and a sa.type of the given types, as label or annotation,
+// the labels winning over the annotations. The services without type or with an unknown type are skipped.
+func DiscoverServices(prom promAPI, types []string) ([]discoveredService, error) {
+	found := make(map[discoveredService]discoveredService)
+	for _, source := range []struct{ query, prefix string }{
+		{query: discoveryAnnotationsQuery, prefix: "annotation_"},
+		{query: discoveryLabelsQuery, prefix: "label_"},
+	} {
+		data, err := prom.Query(source.query)
+		if err != nil {
+			log.Error("PromQL query wrong for ", source.query)
+			return nil, err
+		}
+		for _, elem := range data.(model.Vector) {
+			key := discoveredService{Endpoint: string(elem.Metric["service"]), Namespace: string(elem.Metric["namespace"]), Cluster: string(elem.Metric["cluster"])}
+			service := key
+			service.Product = string(elem.Metric[model.LabelName(source.prefix+"sa_product")])
+			service.Type = string(elem.Metric[model.LabelName(source.prefix+"sa_type")])
+			found[key] = service
+		}
+	}
+
+	result := make([]discoveredService, 0, len(found))
+	for _, service := range found {
+		if !containsString(types, service.Type) {
+			log.Info("Discovery skipping service : ", service.Endpoint, " of namespace ", service.Namespace, " , unknown sa.type ", service.Type)
+			continue
+		}
+		result = append(result, service)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Product != b.Product {
+			return a.Product < b.Product
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Endpoint != b.Endpoint {
+			return a.Endpoint < b.Endpoint
+		}
+		return a.Cluster < b.Cluster
+	})
+	return result, nil
+}
+
+// MergeDiscoveredServices appends the discovered services to the static service map, one mapping entry per product
+// and type. A discovered service already mapped by the static map is overridden, the static map winning.
+func MergeDiscoveredServices(static []services, discovered []discoveredService) ([]services, []discoveredService) {
+	staticMapKeyType, _ := createServicesMaps(static)
+	result := append([]services{}, static...)
+	entries := make(map[[2]string]int)
+	var overridden []discoveredService
+	for _, service := range discovered {
+		if IsMappedEndpoint(UnmappedEndpoint{Namespace: service.Namespace, Endpoint: service.Endpoint}, staticMapKeyType) {
+			overridden = append(overridden, service)
+			continue
+		}
+		//the names are literal, the endpoint, namespace and cluster of the service map being regex
+		endpoint := serviceEndpoint{Name: regexp.QuoteMeta(service.Endpoint), serviceScope: serviceScope{Namespace: regexp.QuoteMeta(service.Namespace), Cluster: regexp.QuoteMeta(service.Cluster)}}
+		key := [2]string{service.Product, service.Type}
+		i, ok := entries[key]
+		if !ok {
+			i = len(result)
+			entries[key] = i
+			result = append(result, services{Product: service.Product, Type: service.Type})
+		}
+		result[i].Endpoints = append(result[i].Endpoints, endpoint)
+	}
+	return result, overridden
+}
+
+// SetStaticServices swaps the service map read from the files, merged with the discovered services if any.
+func (e *Exporter) SetStaticServices(jsonServices []services) {
+	e.servicesMutex.Lock()
+	defer e.servicesMutex.Unlock()
+	e.staticServices = jsonServices
+	e.swapServices(e.DiscoveryStatus())
+	e.setReloadStatus(true)
+}
+
+// SetDiscoveredServices swaps the discovered services, merged with the static service map. The services
+// of the previous discovery are kept if err is set.
+func (e *Exporter) SetDiscoveredServices(discovered []discoveredService, err error) {
+	e.servicesMutex.Lock()
+	defer e.servicesMutex.Unlock()
+	status := discoveryStatus{LastRefresh: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		e.discovered = discovered
+	}
+	e.swapServices(status)
+}
+
+// swapServices merges the static service map with the discovered services and swaps the result in use,
+// along with the discovery status. The caller must hold servicesMutex.
+func (e *Exporter) swapServices(status discoveryStatus) {
+	merged, overridden := MergeDiscoveredServices(e.staticServices, e.discovered)
+	mapKeyType, mapKeyEndpoint := createServicesMaps(merged)
+	productsConfig := createProductsConfig(merged)
+	compileAnchoredPatterns(mapKeyType)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.mapKeyType = mapKeyType
+	e.mapKeyEndpoint = mapKeyEndpoint
+	e.productsConfig = productsConfig
+	status.Discovered = e.discovered
+	status.Overridden = overridden
+	e.discoveryStatus = status
+}
+
+// DiscoveryStatus returns the result of the last discovery.
+func (e *Exporter) DiscoveryStatus() discoveryStatus {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.discoveryStatus
+}
+
+// refreshDiscoveredServices discovers the services from their labels and annotations and swaps them in the exporter.
+func refreshDiscoveredServices(exporter *Exporter) {
+	discovered, err := DiscoverServices(exporter.prom, knownTypes)
+	if err != nil {
+		log.Error("Discovery of the services failed, keeping the previous ones: ", err)
+	} else {
+		log.Info("Discovery found ", len(discovered), " services")
+	}
+	exporter.SetDiscoveredServices(discovered, err)
+}
+
+// discoverServices refreshes the discovered services at start and then periodically.
+func discoverServices(exporter *Exporter, interval time.Duration) {
+	refreshDiscoveredServices(exporter)
+	if interval <= 0 {
+		log.Info("Discovery refresh disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshDiscoveredServices(exporter)
+	}
+}
+
+// discoveryHandler shows the services discovered by the last refresh.
+func discoveryHandler(exporter *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(exporter.DiscoveryStatus())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceEndpointSlice reads the addresses of the services from kube_endpointslice_endpoints instead of the legacy
+// Endpoints API
+const sourceEndpointSlice = "endpointslice"
+
+// defaultSources are the sources that can be selected for the endpoints without one.
+var defaultSources = []string{sourceKubernetes, sourceEndpointSlice}
+
+// endpointSliceNameSuffix is the random suffix added by Kubernetes to the service name to name its EndpointSlices
+const endpointSliceNameSuffix = "-[a-z0-9]{5}"
+
+// IsServiceSource tells if the endpoints of a source are Kubernetes services, having addresses.
+func IsServiceSource(source string) bool {
+	return source == "" || source == sourceKubernetes || source == sourceEndpointSlice
+}
+
+// GetMetricSaEndpointSliceScope retrieves service availability metrics from the kube_endpointslice_endpoints of
+// the endpoints of a type sharing the same scope, counting their ready addresses and apart the serving ones
+// that are terminating.
+func (e *Exporter) GetMetricSaEndpointSliceScope(typeEndpoint string, aggr string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	//1. find the addresses by condition, every address seen at least once during the window being kept.
+	//An address changing of condition has one series per condition set, so the addresses are counted one by one.
+	selector := BuildEndpointSliceSelector(scope, endpoints)
+	total, err := e.QueryEndpointValues("endpoint", BuildEndpointSliceQuery(selector, aggr))
+	if err != nil {
+		return nil
+	}
+	ready, err := e.QueryEndpointValues("endpoint", BuildEndpointSliceQuery(selector+",ready=\"true\"", aggr))
+	if err != nil {
+		return nil
+	}
+	terminating, err := e.QueryEndpointValues("endpoint", BuildEndpointSliceQuery(selector+",ready=\"false\",serving=\"true\",terminating=\"true\"", aggr))
+	if err != nil {
+		return nil
+	}
+	addresses := make(map[string]endpointAddresses)
+	for endpoint, count := range total {
+		addresses[endpoint] = endpointAddresses{Ready: ready[endpoint], Total: count, Terminating: terminating[endpoint]}
+	}
+
+	//2. apply the ready threshold of the endpoints
+	return e.AddressesValues(typeEndpoint, scope, endpoints, sourceEndpointSlice, addresses, "no kube_endpointslice_endpoints series")
+}
+
+// QueryEndpointValues runs a query and returns its values by endpoint, named by label.
+func (e *Exporter) QueryEndpointValues(label string, query string) (map[string]float64, error) {
+	data, err := e.prom.Query(query)
+	if err != nil {
+		log.Error("PromQL query wrong for ", query)
+		return nil, err
+	}
+	log.Info("QueryEndpointValues query : ", query)
+	result := make(map[string]float64)
+	for _, elem := range data.(model.Vector) {
+		result[string(elem.Metric[model.LabelName(label)])] = float64(elem.Value)
+	}
+	return result, nil
+}
+
+// endpointAddresses are the numbers of addresses of an endpoint by condition.
+type endpointAddresses struct {
+	Ready       float64
+	Total       float64
+	Terminating float64
+}
+
+// AddressesValues applies the ready threshold of the endpoints of a type sharing the same scope to their addresses,
+// or replicas for the workloads, the serving but terminating addresses still answering while they drain, so the
+// endpoint is degraded rather than down. The configured endpoints without addresses are missing.
+func (e *Exporter) AddressesValues(typeEndpoint string, scope serviceScope, endpoints []serviceEndpoint, source string, addresses map[string]endpointAddresses, missingReason string) []ProductTypeEndpointValue {
+	_, mapKeyEndpoint := e.ServicesMaps()
+	var result []ProductTypeEndpointValue
+	for endpoint, count := range addresses {
+		for _, product := range FindProductsInEndpoints(endpoint, endpoints, mapKeyEndpoint) {
+			configured := FindConfiguredEndpoint(endpoint, product, endpoints, mapKeyEndpoint)
+			readyValue := ThresholdReadyValue(count.Ready, count.Total, configured.readyThreshold)
+			if e.degradedEnabled {
+				readyValue = ThresholdStateValue(count.Ready, count.Total, configured.readyThreshold)
+				if readyValue == saDown && count.Terminating > 0 {
+					readyValue = saDegraded
+				}
+			}
+			if readyValue < 1.0 {
+				log.Info("SA DOWN for endpoint : ", endpoint, " of ", product, " , #address_ready : ", count.Ready, "/", count.Total, " , #address_terminating : ", count.Terminating)
+			}
+			result = append(result, ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: endpoint, Namespace: scope.Namespace, Cluster: scope.Cluster, Value: readyValue, Weight: weightOrDefault(configured.Weight), Optional: configured.Optional, Source: source, Ready: count.Ready, Total: count.Total, Terminating: count.Terminating})
+		}
+	}
+
+	//find the configured endpoints without any address, ie deleted or misspelled services
+	found := make(map[string]float64)
+	for endpoint, count := range addresses {
+		found[endpoint] = count.Total
+	}
+	for _, endpoint := range FindMissingEndpoints(endpoints, found) {
+		log.Info("SA MISSING for endpoint : ", endpoint.Name, " , ", missingReason)
+		for _, product := range mapKeyEndpoint[endpoint] {
+			result = append(result, ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: endpoint.Name, Namespace: scope.Namespace, Cluster: scope.Cluster, Value: 0.0, Weight: weightOrDefault(endpoint.Weight), Optional: endpoint.Optional, Source: source, Missing: true})
+		}
+	}
+	return result
+}
+
+// BuildEndpointSliceSelector builds the label matchers selecting the EndpointSlices of the endpoints in the given scope,
+// their names being the name of their service followed by a random suffix.
+func BuildEndpointSliceSelector(scope serviceScope, endpoints []serviceEndpoint) string {
+	return "endpointslice=~\"(?:" + BuildSaQueryEndpoints(endpoints) + ")" + endpointSliceNameSuffix + "\"" + BuildScopeSelector(scope)
+}
+
+// BuildEndpointSliceQuery builds the PromQL query counting by service the distinct addresses of the
+// kube_endpointslice_endpoints series matching selector seen during the aggr lookback window,
+// the service being the EndpointSlice name without its suffix.
+func BuildEndpointSliceQuery(selector string, aggr string) string {
+	series := overWindow("kube_endpointslice_endpoints{"+selector+"}", aggr)
+	return "count by (endpoint)(count by (cluster, namespace, endpoint, address)(label_replace(" + series + ", \"endpoint\", \"$1\", \"endpointslice\", \"(.+)" + endpointSliceNameSuffix + "\")))"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// evaluation is the result of the last evaluation of the SA, served by the scrapes in background mode.
+type evaluation struct {
+	metrics   []prometheus.Metric
+	timestamp time.Time
+	duration  time.Duration
+}
+
+// Evaluate computes the SA metrics, from Prometheus or the Kubernetes API, and stores them as the last snapshot.
+func (e *Exporter) Evaluate() evaluation {
+	start := time.Now()
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+	if e.kubeWatcher != nil {
+		e.CollectKubeMetrics(ch)
+	} else {
+		e.CollectPromMetrics(ch)
+	}
+	close(ch)
+	<-done
+
+	result := evaluation{metrics: metrics, timestamp: start, duration: time.Since(start)}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastEvaluation = result
+	log.Info("Evaluation finished in ", result.duration)
+	return result
+}
+
+// LastEvaluation returns the last snapshot of the SA metrics.
+func (e *Exporter) LastEvaluation() evaluation {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.lastEvaluation
+}
+
+// CollectEvaluationMetrics sends the time and duration of the last evaluation.
+func CollectEvaluationMetrics(ch chan<- prometheus.Metric, last evaluation) {
+	timestamp := 0.0
+	if !last.timestamp.IsZero() {
+		timestamp = float64(last.timestamp.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(
+		evaluationTimestamp, prometheus.GaugeValue, timestamp,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		evaluationDuration, prometheus.GaugeValue, last.duration.Seconds(),
+	)
+}
+
+// evaluateServices evaluates the SA in background at every interval, the scrapes serving the last snapshot.
+func evaluateServices(exporter *Exporter, interval time.Duration) {
+	exporter.Evaluate()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		exporter.Evaluate()
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// sourcePromQL evaluates the custom PromQL expression of the endpoints
+const sourcePromQL = "promql"
+
+// expressionPlaceholder matches the {{endpoint}}, {{namespace}}, {{cluster}} and {{window}} placeholders of an expression
+var expressionPlaceholder = regexp.MustCompile(`{{\s*(\w+)\s*}}`)
+
+// expressionPlaceholders are the placeholders accepted in an expression.
+var expressionPlaceholders = []string{"endpoint", "namespace", "cluster", "window"}
+
+// RenderExpression replaces the placeholders of an expression by the endpoint name, its namespace
+// and cluster selectors (.* if not set) and the aggregation window of its type.
+func RenderExpression(expression string, endpoint serviceEndpoint, window string) string {
+	values := map[string]string{
+		"endpoint":  endpoint.Name,
+		"namespace": endpoint.Namespace,
+		"cluster":   endpoint.Cluster,
+		"window":    window,
+	}
+	for _, key := range []string{"namespace", "cluster"} {
+		if values[key] == "" {
+			values[key] = ".*"
+		}
+	}
+	return expressionPlaceholder.ReplaceAllStringFunc(expression, func(placeholder string) string {
+		name := strings.TrimSpace(strings.Trim(placeholder, "{}"))
+		return values[name]
+	})
+}
+
+// GetMetricSaExpressionScope retrieves service availability metrics for the endpoints of a type sharing the same
+// scope by evaluating their own PromQL expression, one query per endpoint.
+func (e *Exporter) GetMetricSaExpressionScope(typeEndpoint string, aggr string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	_, mapKeyEndpoint := e.ServicesMaps()
+	var result []ProductTypeEndpointValue
+	for _, endpoint := range endpoints {
+		query := RenderExpression(endpoint.Expression, endpoint, aggr)
+		data, err := e.prom.Query(query)
+		if err != nil {
+			log.Error("PromQL query wrong for ", query)
+			continue
+		}
+		log.Info("GetMetricSaExpressionScope query : ", query)
+
+		value, found := ExpressionValue(data)
+		if value < 1.0 && found {
+			log.Info("SA DOWN for endpoint : ", endpoint.Name, " , expression value : ", value)
+		}
+		if !found {
+			log.Info("SA MISSING for endpoint : ", endpoint.Name, " , empty expression result")
+		}
+		for _, product := range mapKeyEndpoint[endpoint] {
+			result = append(result, ProductTypeEndpointValue{Product: product, Type: typeEndpoint, Endpoint: endpoint.Name, Namespace: scope.Namespace, Cluster: scope.Cluster, Value: value, Weight: weightOrDefault(endpoint.Weight), Optional: endpoint.Optional, Source: sourcePromQL, Missing: !found})
+		}
+	}
+	return result
+}
+
+// ExpressionValue interprets the result of an expression as availability: the lowest sample of a vector,
+// or the scalar, clamped between 0 and 1. An empty result is not found.
+func ExpressionValue(data model.Value) (float64, bool) {
+	var samples []float64
+	switch v := data.(type) {
+	case model.Vector:
+		for _, sample := range v {
+			samples = append(samples, float64(sample.Value))
+		}
+	case *model.Scalar:
+		samples = append(samples, float64(v.Value))
+	}
+	if len(samples) == 0 {
+		return 0.0, false
+	}
+	value := math.Inf(1)
+	for _, sample := range samples {
+		if math.IsNaN(sample) {
+			sample = 0.0
+		}
+		value = math.Min(value, sample)
+	}
+	return math.Max(0.0, math.Min(1.0, value)), true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dependencyEdge is a dependency of the graph returned by /graph.
+type dependencyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Soft bool   `json:"soft"`
+}
+
+// dependencyGraphJSON is the JSON body returned by /graph.
+type dependencyGraphJSON struct {
+	Products     []string         `json:"products"`
+	Dependencies []dependencyEdge `json:"dependencies"`
+}
+
+// dependencyGraph returns the products of the service map with the products they depend on.
+func dependencyGraph(jsonServices []services) map[string][]productDependency {
+	result := make(map[string][]productDependency)
+	for _, service := range jsonServices {
+		dependencies := result[service.Product]
+		for _, dependency := range service.DependsOn {
+			if !containsDependency(dependencies, dependency.Product) {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		result[service.Product] = dependencies
+	}
+	return result
+}
+
+// dependencyGraphOf returns the dependency graph of the products configuration in use.
+func dependencyGraphOf(productsConfig map[string]productConfig) map[string][]productDependency {
+	result := make(map[string][]productDependency)
+	for product, config := range productsConfig {
+		result[product] = config.dependsOn
+	}
+	return result
+}
+
+// sortedProducts returns the products of the graph in alphabetical order.
+func sortedProducts(graph map[string][]productDependency) []string {
+	result := make([]string, 0, len(graph))
+	for product := range graph {
+		result = append(result, product)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// findDependencyCycle returns the products of the first dependency cycle found, the first product
+// being repeated at the end, or nil if the graph has no cycle.
+func findDependencyCycle(graph map[string][]productDependency) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(product string) []string
+	visit = func(product string) []string {
+		state[product] = visiting
+		path = append(path, product)
+		for _, dependency := range graph[product] {
+			switch state[dependency.Product] {
+			case visiting:
+				for i, p := range path {
+					if p == dependency.Product {
+						return append(append([]string{}, path[i:]...), dependency.Product)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dependency.Product); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[product] = visited
+		return nil
+	}
+	for _, product := range sortedProducts(graph) {
+		if state[product] == unvisited {
+			if cycle := visit(product); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// EffectiveValues returns the SA of every product combined with the SA of the products it depends on:
+// the worst of its own SA and of the effective SA of its dependencies, a soft dependency counting at worst
+// for optionalFloor. A product is down as soon as one of its hard dependencies is down.
+func EffectiveValues(overall map[string]float64, graph map[string][]productDependency, optionalFloor float64) map[string]float64 {
+	result := make(map[string]float64)
+	var effective func(product string, visiting map[string]bool) float64
+	effective = func(product string, visiting map[string]bool) float64 {
+		if value, ok := result[product]; ok {
+			return value
+		}
+		value := overall[product]
+		//cycles are rejected when the service map is loaded, this only protects the recursion
+		visiting[product] = true
+		for _, dependency := range graph[product] {
+			if _, ok := overall[dependency.Product]; !ok || visiting[dependency.Product] {
+				continue
+			}
+			dependencyValue := effective(dependency.Product, visiting)
+			if dependency.Soft && dependencyValue < optionalFloor {
+				dependencyValue = optionalFloor
+			}
+			if dependencyValue < value {
+				log.Info("SA of ", product, " lowered to ", dependencyValue, " by its dependency ", dependency.Product)
+				value = dependencyValue
+			}
+		}
+		delete(visiting, product)
+		result[product] = value
+		return value
+	}
+	for product := range overall {
+		effective(product, make(map[string]bool))
+	}
+	return result
+}
+
+// dependencyGraphDOT returns the graph in the Graphviz DOT format, soft dependencies being dashed.
+func dependencyGraphDOT(graph map[string][]productDependency) string {
+	var sb strings.Builder
+	sb.WriteString("digraph products {\n")
+	for _, product := range sortedProducts(graph) {
+		fmt.Fprintf(&sb, "  %q;\n", product)
+	}
+	for _, product := range sortedProducts(graph) {
+		for _, dependency := range graph[product] {
+			fmt.Fprintf(&sb, "  %q -> %q", product, dependency.Product)
+			if dependency.Soft {
+				sb.WriteString(" [style=dashed]")
+			}
+			sb.WriteString(";\n")
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// graphHandler returns the product dependency graph as JSON, or as DOT with ?format=dot.
+func graphHandler(exporter *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		graph := dependencyGraphOf(exporter.ProductsConfig())
+		if r.URL.Query().Get("format") == "dot" {
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			w.Write([]byte(dependencyGraphDOT(graph)))
+			return
+		}
+
+		body := dependencyGraphJSON{Products: sortedProducts(graph), Dependencies: []dependencyEdge{}}
+		for _, product := range body.Products {
+			for _, dependency := range graph[product] {
+				body.Dependencies = append(body.Dependencies, dependencyEdge{From: product, To: dependency.Product, Soft: dependency.Soft})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+}
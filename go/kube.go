@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	listersdiscoveryv1 "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Collectors of the addresses of the services, through kube-state-metrics in Prometheus or directly from the Kubernetes API.
+const (
+	collectorPrometheus = "prometheus"
+	collectorKubernetes = "kubernetes"
+)
+
+// collectorModes are the collectors that can be selected.
+var collectorModes = []string{collectorPrometheus, collectorKubernetes}
+
+// kubeResync is the period at which the informers replay their cache
+const kubeResync = 10 * time.Minute
+
+// kubeEndpoint are the addresses of a service read from the Kubernetes API.
+type kubeEndpoint struct {
+	Namespace string
+	Name      string
+	endpointAddresses
+}
+
+// kubeWatcher watches the Services, EndpointSlices and Endpoints of the cluster with informers.
+type kubeWatcher struct {
+	factory        informers.SharedInformerFactory
+	services       listerscorev1.ServiceLister
+	endpoints      listerscorev1.EndpointsLister
+	endpointSlices listersdiscoveryv1.EndpointSliceLister
+	synced         []cache.InformerSynced
+}
+
+// newKubeWatcher returns a watcher of the cluster of client, its informers being started by Start.
+func newKubeWatcher(client kubernetes.Interface, resync time.Duration) *kubeWatcher {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	services := factory.Core().V1().Services()
+	endpoints := factory.Core().V1().Endpoints()
+	endpointSlices := factory.Discovery().V1().EndpointSlices()
+	return &kubeWatcher{
+		factory:        factory,
+		services:       services.Lister(),
+		endpoints:      endpoints.Lister(),
+		endpointSlices: endpointSlices.Lister(),
+		synced:         []cache.InformerSynced{services.Informer().HasSynced, endpoints.Informer().HasSynced, endpointSlices.Informer().HasSynced},
+	}
+}
+
+// newKubeClient returns a client of the cluster of the kubeconfig file, of the cluster the exporter runs in if empty.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Start starts the informers until stopCh is closed.
+func (w *kubeWatcher) Start(stopCh <-chan struct{}) {
+	w.factory.Start(stopCh)
+}
+
+// WaitForSync waits for the first list of every informer, false if stopCh is closed before.
+func (w *kubeWatcher) WaitForSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, w.synced...)
+}
+
+// HasSynced tells if every informer has done its first list.
+func (w *kubeWatcher) HasSynced() bool {
+	for _, synced := range w.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Endpoints returns the addresses of every service, counted from its EndpointSlices, from its Endpoints if it has none.
+// A service without any address is returned with a total of 0.
+func (w *kubeWatcher) Endpoints() ([]kubeEndpoint, error) {
+	services, err := w.services.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	slices, err := w.endpointSlices.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	slicesByService := make(map[[2]string][]*discoveryv1.EndpointSlice)
+	for _, slice := range slices {
+		key := [2]string{slice.Namespace, slice.Labels[discoveryv1.LabelServiceName]}
+		slicesByService[key] = append(slicesByService[key], slice)
+	}
+
+	result := make([]kubeEndpoint, 0, len(services))
+	for _, service := range services {
+		endpoint := kubeEndpoint{Namespace: service.Namespace, Name: service.Name}
+		if serviceSlices := slicesByService[[2]string{service.Namespace, service.Name}]; len(serviceSlices) > 0 {
+			endpoint.endpointAddresses = endpointSliceAddresses(serviceSlices)
+		} else if endpoints, err := w.endpoints.Endpoints(service.Namespace).Get(service.Name); err == nil {
+			for _, subset := range endpoints.Subsets {
+				endpoint.Ready += float64(len(subset.Addresses))
+				endpoint.Total += float64(len(subset.Addresses) + len(subset.NotReadyAddresses))
+			}
+		}
+		result = append(result, endpoint)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// endpointSliceAddresses counts the addresses of the EndpointSlices of a service by condition,
+// an unknown ready condition meaning ready like for the Kubernetes API.
+func endpointSliceAddresses(slices []*discoveryv1.EndpointSlice) endpointAddresses {
+	var result endpointAddresses
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			count := float64(len(endpoint.Addresses))
+			result.Total += count
+			conditions := endpoint.Conditions
+			if conditions.Ready == nil || *conditions.Ready {
+				result.Ready += count
+			} else if conditions.Serving != nil && *conditions.Serving && conditions.Terminating != nil && *conditions.Terminating {
+				result.Terminating += count
+			}
+		}
+	}
+	return result
+}
+
+// GetMetricSaKubeScope retrieves service availability metrics from the addresses watched in the Kubernetes API for the
+// endpoints of a type sharing the same scope. The addresses are the current ones, without aggregation window, and the
+// cluster selector is not applied, the API being the one of a single cluster.
+func (e *Exporter) GetMetricSaKubeScope(typeEndpoint string, source string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	kubeEndpoints, err := e.kubeWatcher.Endpoints()
+	if err != nil {
+		log.Error("Kubernetes API cache not readable: ", err)
+		return nil
+	}
+	log.Info("GetMetricSaKubeScope endpoints : ", BuildSaQueryEndpoints(endpoints), " , namespace : ", scope.Namespace)
+
+	//the addresses of the services of the same name are summed over the namespaces, like the PromQL sum by (endpoint)
+	addresses := make(map[string]endpointAddresses)
+	for _, endpoint := range kubeEndpoints {
+		if !MatchesAnyEndpoint(endpoint.Name, endpoints) || (scope.Namespace != "" && !anchoredRegex(scope.Namespace).MatchString(endpoint.Namespace)) {
+			continue
+		}
+		count := addresses[endpoint.Name]
+		count.Ready += endpoint.Ready
+		count.Total += endpoint.Total
+		count.Terminating += endpoint.Terminating
+		addresses[endpoint.Name] = count
+	}
+
+	if source == sourceKubernetes {
+		source = ""
+	}
+	return e.AddressesValues(typeEndpoint, scope, endpoints, source, addresses, "no service in the Kubernetes API")
+}
+
+// CollectKubeMetrics collects the metrics with the addresses of the services watched in the Kubernetes API, the other
+// sources still being queried in Prometheus.
+func (e *Exporter) CollectKubeMetrics(ch chan<- prometheus.Metric) {
+	if !e.kubeWatcher.HasSynced() {
+		ch <- prometheus.MustNewConstMetric(
+			up, prometheus.GaugeValue, 0, collectorKubernetes,
+		)
+		log.Error("Kubernetes API cache not synced yet")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		up, prometheus.GaugeValue, 1, collectorKubernetes,
+	)
+
+	e.HitProm(ch)
+	if e.unmappedEnabled {
+		e.CollectUnmappedEndpoints(ch)
+	}
+}
+
+// MatchesAnyEndpoint tells if a name matches the name of any of the endpoints.
+func MatchesAnyEndpoint(name string, endpoints []serviceEndpoint) bool {
+	for _, endpoint := range endpoints {
+		if anchoredRegex(endpoint.Name).MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
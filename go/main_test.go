@@ -1,18 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kuberuntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 // Init
@@ -40,6 +58,88 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// endpointsOf returns unscoped endpoints with the given names
+func endpointsOf(names ...string) []serviceEndpoint {
+	var result []serviceEndpoint
+	for _, name := range names {
+		result = append(result, serviceEndpoint{Name: name})
+	}
+	return result
+}
+
+// fakeSeries is a series returned by fakePrometheus
+type fakeSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// fakePrometheus starts a Prometheus API answering the instant queries with the series returned by results.
+func fakePrometheus(t *testing.T, results func(query string) []fakeSeries) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("fakePrometheus not able to parse the request: %v", err)
+		}
+		var vector []map[string]interface{}
+		for _, series := range results(r.Form.Get("query")) {
+			vector = append(vector, map[string]interface{}{
+				"metric": series.labels,
+				"value":  []interface{}{float64(time.Now().Unix()), strconv.FormatFloat(series.value, 'f', -1, 64)},
+			})
+		}
+		if vector == nil {
+			vector = []map[string]interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": vector},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// endpointSeries returns one series per endpoint with the given value
+func endpointSeries(values map[string]float64) []fakeSeries {
+	var result []fakeSeries
+	for endpoint, value := range values {
+		result = append(result, fakeSeries{labels: map[string]string{"endpoint": endpoint}, value: value})
+	}
+	return result
+}
+
+// kubeEndpointAddress answers the queries of the exporter like Prometheus would with these kube_endpoint_address
+// series: the total and not ready addresses of the endpoints selected by the query.
+func kubeEndpointAddress(total map[string]float64, notReady map[string]float64) func(query string) []fakeSeries {
+	selected := regexp.MustCompile(`endpoint=~"([^"]*)"`)
+	ready := make(map[string]float64)
+	for endpoint, value := range total {
+		if value > notReady[endpoint] {
+			ready[endpoint] = value - notReady[endpoint]
+		}
+	}
+	return func(query string) []fakeSeries {
+		if query == "up{job=\"prometheus\"}" {
+			return []fakeSeries{{labels: map[string]string{"job": "prometheus"}, value: 1}}
+		}
+		values := total
+		if strings.Contains(query, `ready="true"`) {
+			values = ready
+		}
+		match := selected.FindStringSubmatch(query)
+		if match == nil {
+			return nil
+		}
+		result := make(map[string]float64)
+		for _, endpoint := range strings.Split(match[1], "|") {
+			if value, ok := values[endpoint]; ok {
+				result[endpoint] = value
+			}
+		}
+		return endpointSeries(result)
+	}
+}
+
 // main.go
 func TestReady(t *testing.T) {
 	want := "SA Exporter is ready to rock"
@@ -76,7 +176,7 @@ func TestInit(t *testing.T) {
 
 	// Check that Car product is mapped correctly
 	wantProduct := "Car"
-	if products, exists := tempMapKeyEndpoint["Tires"]; exists && len(products) > 0 {
+	if products, exists := tempMapKeyEndpoint[serviceEndpoint{Name: "Tires"}]; exists && len(products) > 0 {
 		gotProduct := products[0]
 		if gotProduct != wantProduct {
 			t.Errorf("Init() Product = %q, want %q", gotProduct, wantProduct)
@@ -96,7 +196,7 @@ func TestInit(t *testing.T) {
 		wantEndpoint := "Wheel"
 		found := false
 		for _, endpoint := range endpoints {
-			if endpoint == wantEndpoint {
+			if endpoint.Name == wantEndpoint {
 				found = true
 				break
 			}
@@ -109,10 +209,211 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func TestParseAggrWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		aggr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset uses default", aggr: "", want: "1m"},
+		{name: "valid duration", aggr: "5m", want: "5m"},
+		{name: "valid compound duration", aggr: "1h30m", want: "1h30m"},
+		{name: "invalid duration", aggr: "5 minutes", wantErr: true},
+		{name: "missing unit", aggr: "5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAggrWindow(tt.aggr, "1m")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAggrWindow() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseAggrWindow() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceEndpointUnmarshalJSON(t *testing.T) {
+	data := `[{"product":"Metrics","type":"batch","namespace":"monitoring",
+		"endpoints": [
+			"prometheus",
+			{"name":"kube-state-metrics","namespace":"kube-system","cluster":"eu-1"}
+		]
+	}]`
+	var got []services
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	want := []services{
+		{
+			Product:      "Metrics",
+			Type:         "batch",
+			serviceScope: serviceScope{Namespace: "monitoring"},
+			Endpoints: []serviceEndpoint{
+				{Name: "prometheus"},
+				{Name: "kube-state-metrics", serviceScope: serviceScope{Namespace: "kube-system", Cluster: "eu-1"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateServicesMapsSharedEndpoint(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Motor")},
+		{Product: "Plane", Type: "batch", Endpoints: endpointsOf("Motor")},
+	})
+
+	if !reflect.DeepEqual(mapKeyType["batch"], endpointsOf("Motor")) {
+		t.Errorf("createServicesMaps() batch endpoints = %v, want [Motor]", mapKeyType["batch"])
+	}
+	if got := mapKeyEndpoint[serviceEndpoint{Name: "Motor"}]; !reflect.DeepEqual(got, []string{"Car", "Plane"}) {
+		t.Errorf("createServicesMaps() Motor products = %v, want [Car Plane]", got)
+	}
+}
+
+func TestCreateServicesMapsScope(t *testing.T) {
+	testServices := []services{
+		{Product: "Metrics", Type: "batch", serviceScope: serviceScope{Namespace: "monitoring", Cluster: "eu-1"}, Endpoints: []serviceEndpoint{
+			{Name: "prometheus"},
+			{Name: "kube-state-metrics", serviceScope: serviceScope{Namespace: "kube-system"}},
+		}},
+		{Product: "Platform", Type: "batch", serviceScope: serviceScope{Namespace: "platform"}, Endpoints: endpointsOf("prometheus")},
+	}
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps(testServices)
+
+	wantBatch := []serviceEndpoint{
+		{Name: "prometheus", serviceScope: serviceScope{Namespace: "monitoring", Cluster: "eu-1"}},
+		{Name: "kube-state-metrics", serviceScope: serviceScope{Namespace: "kube-system", Cluster: "eu-1"}},
+		{Name: "prometheus", serviceScope: serviceScope{Namespace: "platform"}},
+	}
+	if !reflect.DeepEqual(mapKeyType["batch"], wantBatch) {
+		t.Errorf("createServicesMaps() batch endpoints = %v, want %v", mapKeyType["batch"], wantBatch)
+	}
+
+	// the same endpoint name in 2 namespaces must not collide
+	if len(mapKeyEndpoint) != 3 {
+		t.Errorf("createServicesMaps() mapKeyEndpoint length = %v, want %v", len(mapKeyEndpoint), 3)
+	}
+	got := mapKeyEndpoint[serviceEndpoint{Name: "prometheus", serviceScope: serviceScope{Namespace: "platform"}}]
+	if !reflect.DeepEqual(got, []string{"Platform"}) {
+		t.Errorf("createServicesMaps() prometheus platform products = %v, want [Platform]", got)
+	}
+}
+
+func TestCreateServicesMapsThreshold(t *testing.T) {
+	mapKeyType, _ := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", readyThreshold: readyThreshold{MinReady: 2, MinReadyRatio: 0.5}, Endpoints: []serviceEndpoint{
+			{Name: "Motor"},
+			{Name: "Tires", readyThreshold: readyThreshold{MinReadyRatio: 0.8}},
+		}},
+	})
+
+	want := []serviceEndpoint{
+		{Name: "Motor", readyThreshold: readyThreshold{MinReady: 2, MinReadyRatio: 0.5}},
+		{Name: "Tires", readyThreshold: readyThreshold{MinReady: 2, MinReadyRatio: 0.8}},
+	}
+	if !reflect.DeepEqual(mapKeyType["batch"], want) {
+		t.Errorf("createServicesMaps() batch endpoints = %v, want %v", mapKeyType["batch"], want)
+	}
+}
+
+func TestAnchoredRegex(t *testing.T) {
+	mapKeyType, _ := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", serviceScope: serviceScope{Namespace: "car-.*"}, Endpoints: endpointsOf("Tires-.*")},
+	})
+	compileAnchoredPatterns(mapKeyType)
+
+	if anchoredRegex("Tires-.*") != anchoredRegex("Tires-.*") || anchoredRegex("car-.*") != anchoredRegex("car-.*") {
+		t.Error("anchoredRegex() compiled again a pattern of the service map")
+	}
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{pattern: "Tires-.*", value: "Tires-front", want: true},
+		{pattern: "Tires-.*", value: "Spare-Tires-front", want: false},
+		{pattern: "car-.*", value: "car-eu", want: true},
+		{pattern: "Motor|Wheel", value: "Wheel", want: true},
+		{pattern: "Motor|Wheel", value: "Motorbike", want: false},
+	}
+	for _, tt := range tests {
+		if got := anchoredRegex(tt.pattern).MatchString(tt.value); got != tt.want {
+			t.Errorf("anchoredRegex(%q).MatchString(%q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseTypesAggr(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: map[string]string{}},
+		{name: "single type", value: "api=2m", want: map[string]string{"api": "2m"}},
+		{name: "several types with spaces", value: "api=2m, streaming = 30s,storage=10m,", want: map[string]string{"api": "2m", "streaming": "30s", "storage": "10m"}},
+		{name: "missing window", value: "api=", wantErr: true},
+		{name: "missing type", value: "=2m", wantErr: true},
+		{name: "not type=window", value: "api", wantErr: true},
+		{name: "invalid window", value: "api=2 minutes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTypesAggr(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTypesAggr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTypesAggr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTypesAggr(t *testing.T) {
+	os.Setenv("SA_BATCH_AGGR", "10m")
+	os.Setenv("SA_TYPES_AGGR", "api=2m,streaming=30s")
+	defer func() {
+		os.Unsetenv("SA_BATCH_AGGR")
+		os.Unsetenv("SA_TYPES_AGGR")
+	}()
+
+	got, err := loadTypesAggr()
+	if err != nil {
+		t.Fatalf("loadTypesAggr() error = %v", err)
+	}
+	want := map[string]string{"interactive": "1m", "batch": "10m", "api": "2m", "streaming": "30s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadTypesAggr() = %v, want %v", got, want)
+	}
+	if types := sortedTypes(got); !reflect.DeepEqual(types, []string{"api", "batch", "interactive", "streaming"}) {
+		t.Errorf("sortedTypes() = %v", types)
+	}
+
+	os.Setenv("SA_TYPES_AGGR", "api")
+	if _, err := loadTypesAggr(); err == nil {
+		t.Error("loadTypesAggr() expected error for invalid SA_TYPES_AGGR but got nil")
+	}
+}
+
 // api_prom.go
 
 func TestPromNoConnection_query(t *testing.T) {
-	_, err := PromQuery("http://foo:9090", "up{job=\"prometheus\"}")
+	_, err := newPromClient("http://foo:9090", defaultPromTimeout).Query("up{job=\"prometheus\"}")
 	if err == nil {
 		t.Error("TestPromNoConnection_query() expected error but got nil")
 	}
@@ -120,94 +421,2245 @@ func TestPromNoConnection_query(t *testing.T) {
 	if !strings.Contains(err.Error(), "dial tcp") {
 		t.Errorf("TestPromNoConnection_query() = %q, expected dial tcp error", err)
 	}
-}
+}
+
+func TestPromNoConnection_queryRange(t *testing.T) {
+	_, err := newPromClient("http://foo:9090", defaultPromTimeout).QueryRange("up{job=\"prometheus\"}", time.Now().Add(-time.Hour), time.Now(), time.Minute)
+	if err == nil {
+		t.Error("TestPromNoConnection_queryRange() expected error but got nil")
+	}
+	// Just check that we get a connection error, don't check specific DNS resolver message
+	if !strings.Contains(err.Error(), "dial tcp") {
+		t.Errorf("TestPromNoConnection_queryRange() = %q, expected dial tcp error", err)
+	}
+}
+
+func TestPromNoConnection_series(t *testing.T) {
+	_, err := newPromClient("http://foo:9090", defaultPromTimeout).Series("up{job=\"prometheus\"}", time.Now().Add(-time.Hour), time.Now())
+	if err == nil {
+		t.Error("TestPromNoConnection_series() expected error but got nil")
+	}
+	// Just check that we get a connection error, don't check specific DNS resolver message
+	if !strings.Contains(err.Error(), "dial tcp") {
+		t.Errorf("TestPromNoConnection_series() = %q, expected dial tcp error", err)
+	}
+}
+
+func TestPromClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := newPromClient(server.URL, 50*time.Millisecond).Query("up")
+	if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Errorf("Query() error = %v, want context deadline exceeded", err)
+	}
+}
+
+func TestPromClientReusesConnections(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	client := newPromClient(server.URL, defaultPromTimeout)
+	for i := 0; i < 5; i++ {
+		if _, err := client.Query("up"); err != nil {
+			t.Fatalf("Query() unexpected error: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&connections); got != 1 {
+		t.Errorf("5 queries opened %d connections, want 1", got)
+	}
+}
+
+// fakePromAPI answers the queries with these series, or fails with err, only the queries containing failOn if set
+type fakePromAPI struct {
+	results func(query string) []fakeSeries
+	err     error
+	failOn  string
+	queries []string
+}
+
+func (f *fakePromAPI) Query(query string) (model.Value, error) {
+	f.queries = append(f.queries, query)
+	if f.err != nil && strings.Contains(query, f.failOn) {
+		return nil, f.err
+	}
+	vector := model.Vector{}
+	for _, series := range f.results(query) {
+		metric := model.Metric{}
+		for name, value := range series.labels {
+			metric[model.LabelName(name)] = model.LabelValue(value)
+		}
+		vector = append(vector, &model.Sample{Metric: metric, Value: model.SampleValue(series.value)})
+	}
+	return vector, nil
+}
+
+func (f *fakePromAPI) QueryRange(query string, start time.Time, end time.Time, step time.Duration) (model.Value, error) {
+	return f.Query(query)
+}
+
+func (f *fakePromAPI) Series(query string, start time.Time, end time.Time) (string, error) {
+	return "", f.err
+}
+
+func TestExporterFakePromAPI(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")}})
+	exporter := NewExporter(newPromClient("http://unused:9090", defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+	fake := &fakePromAPI{results: kubeEndpointAddress(map[string]float64{"Motor": 2}, map[string]float64{"Motor": 1})}
+	exporter.prom = fake
+
+	want := `
+# HELP sa_prom_up Was the dependancy up
+# TYPE sa_prom_up gauge
+sa_prom_up{dependancy="prometheus"} 1
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_prom_up", "sa_service"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+	if len(fake.queries) == 0 || fake.queries[0] != `up{job="prometheus"}` {
+		t.Errorf("Collect() queries = %v, want the up query first", fake.queries)
+	}
+
+	fake.err = fmt.Errorf("prometheus unreachable")
+	want = `
+# HELP sa_prom_up Was the dependancy up
+# TYPE sa_prom_up gauge
+sa_prom_up{dependancy="prometheus"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_prom_up", "sa_service"); err != nil {
+		t.Errorf("Collect() with Prometheus down unexpected metrics: %v", err)
+	}
+}
+
+func TestDecodeServicesFormats(t *testing.T) {
+	want := []services{
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel", "Gear")},
+		{Product: "Car", Type: "batch", serviceScope: serviceScope{Namespace: "car"}, Endpoints: []serviceEndpoint{
+			{Name: "Motor"},
+			{Name: "Tires", serviceScope: serviceScope{Namespace: "garage", Cluster: "eu-1"}},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+	}{
+		{
+			name:     "json",
+			filename: "services.json",
+			content: `[
+				{"product":"Car","type":"interactive","endpoints":["Wheel","Gear"]},
+				{"product":"Car","type":"batch","namespace":"car","endpoints":["Motor",{"name":"Tires","namespace":"garage","cluster":"eu-1"}]}
+			]`,
+		},
+		{
+			name:     "yaml",
+			filename: "services.yaml",
+			content: `
+- product: Car
+  type: interactive
+  endpoints: [Wheel, Gear]
+- product: Car
+  type: batch
+  namespace: car
+  endpoints:
+    - Motor
+    - name: Tires
+      namespace: garage
+      cluster: eu-1
+`,
+		},
+		{
+			name:     "yml",
+			filename: "services.yml",
+			content:  `[{product: Car, type: interactive, endpoints: [Wheel, Gear]}, {product: Car, type: batch, namespace: car, endpoints: [Motor, {name: Tires, namespace: garage, cluster: eu-1}]}]`,
+		},
+		{
+			name:     "toml",
+			filename: "services.toml",
+			content: `
+[[services]]
+product = "Car"
+type = "interactive"
+endpoints = ["Wheel", "Gear"]
+
+[[services]]
+product = "Car"
+type = "batch"
+namespace = "car"
+endpoints = ["Motor", { name = "Tires", namespace = "garage", cluster = "eu-1" }]
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tt.filename)
+			if err := os.WriteFile(filename, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("Failed to write service map: %v", err)
+			}
+			got, err := loadServices(filename)
+			if err != nil {
+				t.Fatalf("loadServices() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadServices() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeServicesFormatsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		wantErr  string
+	}{
+		{
+			name:     "yaml unknown field",
+			filename: "services.yaml",
+			content:  "- product: Car\n  type: batch\n  endpoint: [Motor]\n",
+			wantErr:  `unknown field "endpoint"`,
+		},
+		{
+			name:     "yaml unknown endpoint field",
+			filename: "services.yaml",
+			content:  "- product: Car\n  type: batch\n  endpoints: [{name: Motor, ns: car}]\n",
+			wantErr:  `unknown field "ns"`,
+		},
+		{
+			name:     "yaml syntax error",
+			filename: "services.yaml",
+			content:  "- product: [Car\n",
+			wantErr:  "is not well formated",
+		},
+		{
+			name:     "yaml validation error",
+			filename: "services.yml",
+			content:  "- product: Car\n  type: frontend\n  endpoints: [Motor]\n",
+			wantErr:  `unknown type "frontend"`,
+		},
+		{
+			name:     "toml unknown key",
+			filename: "services.toml",
+			content:  "[[service]]\nproduct = \"Car\"\n",
+			wantErr:  `unknown key "service"`,
+		},
+		{
+			name:     "toml unknown field",
+			filename: "services.toml",
+			content:  "[[services]]\nproduct = \"Car\"\ntype = \"batch\"\nendpoint = [\"Motor\"]\n",
+			wantErr:  `unknown field "endpoint"`,
+		},
+		{
+			name:     "unsupported extension",
+			filename: "services.txt",
+			content:  "Car",
+			wantErr:  "unsupported extension",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tt.filename)
+			if err := os.WriteFile(filename, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("Failed to write service map: %v", err)
+			}
+			_, err := loadServices(filename)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadServices() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// validate.go
+func TestValidateServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []services
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			services: []services{
+				{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel", "Gear")},
+				{Product: "Car", Type: "batch", serviceScope: serviceScope{Namespace: "car-.*"}, Endpoints: endpointsOf("Motor", "Tires-.*")},
+			},
+		},
+		{
+			name:     "unknown type",
+			services: []services{{Product: "Car", Type: "frontend", Endpoints: endpointsOf("Wheel")}},
+			wantErrs: []string{`entry 0 (product "Car" type "frontend"): unknown type "frontend", expected one of batch, interactive`},
+		},
+		{
+			name:     "empty endpoints",
+			services: []services{{Product: "Car", Type: "batch"}},
+			wantErrs: []string{`entry 0 (product "Car" type "batch"): no endpoints`},
+		},
+		{
+			name: "duplicate product",
+			services: []services{
+				{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+				{Product: "Car", Type: "batch", Endpoints: endpointsOf("Tires")},
+			},
+			wantErrs: []string{`entry 1 (product "Car" type "batch"): duplicate of entry 0`},
+		},
+		{
+			name: "invalid regex",
+			services: []services{{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+				{Name: "Motor("},
+				{Name: "Tires", serviceScope: serviceScope{Namespace: "[car"}},
+			}}},
+			wantErrs: []string{
+				"entry 0 (product \"Car\" type \"batch\"): endpoint \"Motor(\" is not a valid regex: error parsing regexp: missing closing ): `Motor(`",
+				"entry 0 (product \"Car\" type \"batch\") endpoint Tires: namespace \"[car\" is not a valid regex: error parsing regexp: missing closing ]: `[car`",
+			},
+		},
+		{
+			name: "invalid threshold",
+			services: []services{{Product: "Car", Type: "batch", readyThreshold: readyThreshold{MinReady: -1}, Endpoints: []serviceEndpoint{
+				{Name: "Tires", readyThreshold: readyThreshold{MinReadyRatio: 1.5}},
+			}}},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch"): min_ready -1 is negative`,
+				`entry 0 (product "Car" type "batch") endpoint Tires: min_ready_ratio 1.5 is not between 0 and 1`,
+			},
+		},
+		{
+			name: "invalid aggregation",
+			services: []services{
+				{Product: "Car", Type: "batch", Aggregation: aggregationConfig{Strategy: "majority"}, OverallAggregation: aggregationConfig{Strategy: strategyAnyUp}, Endpoints: endpointsOf("Motor")},
+				{Product: "Car", Type: "interactive", Aggregation: aggregationConfig{Strategy: strategyQuorum}, OverallAggregation: aggregationConfig{Strategy: strategyAllUp}, Endpoints: endpointsOf("Wheel")},
+			},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch") aggregation: unknown strategy "majority", expected one of all-up, any-up, quorum, weighted-average, percentage-up`,
+				`entry 1 (product "Car" type "interactive") aggregation: quorum must be at least 1`,
+				`entry 1 (product "Car" type "interactive"): overall_aggregation differs from the one of entry 0`,
+			},
+		},
+		{
+			name: "invalid aggregation threshold",
+			services: []services{
+				{Product: "Car", Type: "batch", Aggregation: aggregationConfig{Strategy: strategyWeightedAverage, Threshold: 1.5}, Endpoints: endpointsOf("Motor")},
+				{Product: "Car", Type: "interactive", Aggregation: aggregationConfig{Strategy: strategyAnyUp, Threshold: 0.5}, Endpoints: endpointsOf("Wheel")},
+			},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch") aggregation: threshold 1.5 is not between 0 and 1`,
+				`entry 1 (product "Car" type "interactive") aggregation: threshold is only used by the weighted-average strategy`,
+			},
+		},
+		{
+			name: "invalid probe",
+			services: []services{{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+				{Name: "Motor", Probe: &probeConfig{Combine: "xor", Timeout: "5 seconds"}},
+				{Name: "Tires", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: "tires:8080/health", StatusCodes: []int{42}, BodyRegex: "ok("}}},
+			}}},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch") endpoint Motor: probe has 0 modules, expected one of http, tcp or grpc`,
+				`entry 0 (product "Car" type "batch") endpoint Motor: unknown probe combine "xor", expected one of and, or, probe, none`,
+				`entry 0 (product "Car" type "batch") endpoint Motor: probe timeout "5 seconds" is not valid: not a valid duration string: "5 seconds"`,
+				`entry 0 (product "Car" type "batch") endpoint Tires: probe url "tires:8080/health" is not a valid http or https URL`,
+				"entry 0 (product \"Car\" type \"batch\") endpoint Tires: probe body_regex \"ok(\" is not a valid regex: error parsing regexp: missing closing ): `ok(`",
+				`entry 0 (product "Car" type "batch") endpoint Tires: probe status code 42 is not valid`,
+			},
+		},
+		{
+			name: "invalid tcp and grpc probes",
+			services: []services{{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+				{Name: "Motor", Probe: &probeConfig{TCP: &tcpProbeConfig{Address: "motor"}, GRPC: &grpcProbeConfig{Address: "motor:9090"}}},
+				{Name: "Tires", Probe: &probeConfig{GRPC: &grpcProbeConfig{Address: "tires"}}},
+			}}},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch") endpoint Motor: probe has 2 modules, expected one of http, tcp or grpc`,
+				`entry 0 (product "Car" type "batch") endpoint Motor: probe tcp address "motor" is not valid: address motor: missing port in address`,
+				`entry 0 (product "Car" type "batch") endpoint Tires: probe grpc address "tires" is not valid: address tires: missing port in address`,
+			},
+		},
+		{
+			name:     "unknown source",
+			services: []services{{Product: "Car", Type: "batch", Source: "pingdom", Endpoints: endpointsOf("Motor")}},
+			wantErrs: []string{`entry 0 (product "Car" type "batch"): unknown source "pingdom", expected one of kubernetes, endpointslice, blackbox, promql, deployment, statefulset, daemonset`},
+		},
+		{
+			name: "expression",
+			services: []services{{Product: "Car", Type: "batch", Source: sourcePromQL, Endpoints: []serviceEndpoint{
+				{Name: "Motor", Expression: `avg(up{job="{{endpoint}}",namespace=~"{{namespace}}"})`},
+				{Name: "Wheel", Expression: `up{job="{{ job }}"}`},
+				{Name: "Tires"},
+				{Name: "Radio", Source: sourceBlackbox, Expression: `up`},
+			}}},
+			wantErrs: []string{
+				`entry 0 (product "Car" type "batch") endpoint Wheel: unknown placeholder {{ job }} in expression, expected one of endpoint, namespace, cluster, window`,
+				`entry 0 (product "Car" type "batch") endpoint Tires: source promql needs an expression`,
+				`entry 0 (product "Car" type "batch") endpoint Radio: expression is only used by the promql source, not blackbox`,
+			},
+		},
+		{
+			name:     "self dependency",
+			services: []services{{Product: "Car", Type: "batch", DependsOn: []productDependency{{Product: "Car"}}, Endpoints: endpointsOf("Motor")}},
+			wantErrs: []string{`entry 0 (product "Car" type "batch"): depends on itself`},
+		},
+		{
+			name:     "empty product and endpoint name",
+			services: []services{{Type: "batch", Endpoints: endpointsOf("")}},
+			wantErrs: []string{
+				`entry 0 (product "" type "batch"): product is empty`,
+				`entry 0 (product "" type "batch"): endpoint name is empty`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range validateServices(tt.services, knownTypes) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.wantErrs) {
+				t.Errorf("validateServices() = %q, want %q", got, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestLoadServicesStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			content: `[{"product":"Car","type":"batch","endpoint":["Motor"]}]`,
+			wantErr: `json: unknown field "endpoint"`,
+		},
+		{
+			name:    "unknown endpoint field",
+			content: `[{"product":"Car","type":"batch","endpoints":[{"name":"Motor","ns":"car"}]}]`,
+			wantErr: `json: unknown field "ns"`,
+		},
+		{
+			name:    "validation error",
+			content: `[{"product":"Car","type":"batch","endpoints":[]}]`,
+			wantErr: "is not valid:\n  - entry 0 (product \"Car\" type \"batch\"): no endpoints",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeServiceMap(t, tt.content)
+			_, err := loadServices(filepath.Join(dir, "services.json"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadServices() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	valid := writeServiceMap(t, `[{"product":"Car","type":"batch","endpoints":["Motor"]}]`)
+	invalid := writeServiceMap(t, `[{"product":"Car","type":"frontend","endpoints":["Motor"]}]`)
+	cycle := writeServiceMap(t, `[
+		{"product":"A","type":"batch","depends_on":["B"],"endpoints":["a"]},
+		{"product":"B","type":"batch","depends_on":["A"],"endpoints":["b"]},
+		{"product":"C","type":"batch","depends_on":["Unknown"],"endpoints":["c"]}
+	]`)
+	dependency := writeServiceMap(t, `[{"product":"Shop","type":"batch","depends_on":["Car"],"endpoints":["shop"]}]`)
+	conflict := writeServiceMap(t, `[{"product":"Car","type":"batch","endpoints":["Motor","Tires"]}]`)
+
+	tests := []struct {
+		name      string
+		filenames []string
+		want      int
+	}{
+		{name: "no file", filenames: nil, want: 2},
+		{name: "valid file", filenames: []string{filepath.Join(valid, "services.json")}, want: 0},
+		{name: "invalid file", filenames: []string{filepath.Join(valid, "services.json"), filepath.Join(invalid, "services.json")}, want: 1},
+		{name: "missing file", filenames: []string{"non-existent.json"}, want: 1},
+		{name: "dependency cycle and unknown product", filenames: []string{filepath.Join(cycle, "services.json")}, want: 1},
+		{name: "unknown product", filenames: []string{filepath.Join(dependency, "services.json")}, want: 1},
+		{name: "dependency in another file", filenames: []string{filepath.Join(valid, "services.json"), filepath.Join(dependency, "services.json")}, want: 0},
+		{name: "endpoint defined in two files", filenames: []string{filepath.Join(valid, "services.json"), filepath.Join(conflict, "services.json")}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateCommand(tt.filenames); got != tt.want {
+				t.Errorf("validateCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// aggregation.go
+func TestAggregationStrategies(t *testing.T) {
+	values := []weightedValue{{Value: 1, Weight: 3}, {Value: 0, Weight: 1}, {Value: 1, Weight: 1}, {Value: 0.5, Weight: 1}}
+
+	tests := []struct {
+		name   string
+		config aggregationConfig
+		values []weightedValue
+		want   float64
+	}{
+		{name: "all-up by default", config: aggregationConfig{}, values: values, want: 0},
+		{name: "all-up", config: aggregationConfig{Strategy: strategyAllUp}, values: []weightedValue{{1, 1}, {1, 1}}, want: 1},
+		{name: "any-up", config: aggregationConfig{Strategy: strategyAnyUp}, values: values, want: 1},
+		{name: "any-up degraded", config: aggregationConfig{Strategy: strategyAnyUp}, values: []weightedValue{{0, 1}, {0.5, 1}}, want: 0.5},
+		{name: "any-up all down", config: aggregationConfig{Strategy: strategyAnyUp}, values: []weightedValue{{0, 1}, {0, 1}}, want: 0},
+		{name: "quorum reached", config: aggregationConfig{Strategy: strategyQuorum, Quorum: 2}, values: values, want: 1},
+		{name: "quorum with degraded", config: aggregationConfig{Strategy: strategyQuorum, Quorum: 3}, values: values, want: 0.5},
+		{name: "quorum not reached", config: aggregationConfig{Strategy: strategyQuorum, Quorum: 4}, values: values, want: 0},
+		{name: "weighted-average", config: aggregationConfig{Strategy: strategyWeightedAverage}, values: values, want: 0.75},
+		{name: "weighted-average no weight", config: aggregationConfig{Strategy: strategyWeightedAverage}, values: []weightedValue{{1, 0}}, want: 0},
+		{name: "percentage-up reached", config: aggregationConfig{Strategy: strategyPercentageUp, Percentage: 50}, values: values, want: 1},
+		{name: "percentage-up not reached", config: aggregationConfig{Strategy: strategyPercentageUp, Percentage: 75}, values: values, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := newAggregationStrategy(tt.config, propagateDegraded)
+			if got := strategy.Aggregate(tt.values, "test"); got != tt.want {
+				t.Errorf("%T.Aggregate() = %v, want %v", strategy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThresholdState(t *testing.T) {
+	tests := []struct {
+		name            string
+		value           float64
+		threshold       float64
+		degradedEnabled bool
+		want            float64
+	}{
+		{name: "up", value: 1, want: saUp},
+		{name: "down", value: 0, degradedEnabled: true, want: saDown},
+		{name: "fraction without degraded", value: 0.75, want: saDown},
+		{name: "fraction with degraded", value: 0.75, degradedEnabled: true, want: saDegraded},
+		{name: "degraded kept", value: 0.5, degradedEnabled: true, want: saDegraded},
+		{name: "threshold reached", value: 0.75, threshold: 0.75, want: saUp},
+		{name: "threshold not reached", value: 0.7, threshold: 0.75, degradedEnabled: true, want: saDegraded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ThresholdState(tt.value, tt.threshold, tt.degradedEnabled); got != tt.want {
+				t.Errorf("ThresholdState(%v, %v, %v) = %v, want %v", tt.value, tt.threshold, tt.degradedEnabled, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateProductsConfig(t *testing.T) {
+	got := createProductsConfig([]services{
+		{Product: "Ingress", Type: "interactive", Aggregation: aggregationConfig{Strategy: strategyAnyUp}, Weight: 2, Endpoints: endpointsOf("nginx-a", "nginx-b")},
+		{Product: "Ingress", Type: "batch", OverallAggregation: aggregationConfig{Strategy: strategyWeightedAverage}, Endpoints: endpointsOf("cert-manager")},
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+	})
+
+	want := map[string]productConfig{
+		"Ingress": {
+			aggregation: aggregationConfig{Strategy: strategyWeightedAverage},
+			types: map[string]typeConfig{
+				"interactive": {aggregation: aggregationConfig{Strategy: strategyAnyUp}, weight: 2},
+				"batch":       {},
+			},
+		},
+		"Car": {types: map[string]typeConfig{"batch": {}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("createProductsConfig() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExporterHitPromAggregation(t *testing.T) {
+	jsonServices := []services{
+		{Product: "Ingress", Type: "interactive", Aggregation: aggregationConfig{Strategy: strategyAnyUp}, Weight: 3, Endpoints: endpointsOf("nginx-a", "nginx-b")},
+		{Product: "Ingress", Type: "batch", OverallAggregation: aggregationConfig{Strategy: strategyWeightedAverage}, Endpoints: endpointsOf("cert-manager")},
+	}
+	mapKeyType, mapKeyEndpoint := createServicesMaps(jsonServices)
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"nginx-a": 2, "nginx-b": 2, "cert-manager": 1},
+		map[string]float64{"nginx-b": 2, "cert-manager": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.SetProductsConfig(createProductsConfig(jsonServices))
+
+	want := `
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Ingress"} 0.75
+# HELP sa_service_state Overall Service Availability state of the product, 1 for its current state among up, degraded and down
+# TYPE sa_service_state gauge
+sa_service_state{cluster="",namespace="",product="Ingress",state="degraded"} 0
+sa_service_state{cluster="",namespace="",product="Ingress",state="down"} 1
+sa_service_state{cluster="",namespace="",product="Ingress",state="up"} 0
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Ingress",type="batch"} 0
+sa_service_type{cluster="",namespace="",product="Ingress",type="interactive"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_type", "sa_service_overall", "sa_service_state"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromWeightedAverageState(t *testing.T) {
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"nginx-a": 1, "nginx-b": 1, "nginx-c": 1, "nginx-d": 1},
+		map[string]float64{"nginx-d": 1},
+	))
+
+	tests := []struct {
+		name            string
+		threshold       float64
+		degradedEnabled bool
+		wantOverall     float64
+		wantState       string
+	}{
+		{name: "below threshold", wantOverall: 0, wantState: "down"},
+		{name: "below threshold degraded", degradedEnabled: true, wantOverall: 0.5, wantState: "degraded"},
+		{name: "threshold reached", threshold: 0.7, wantOverall: 1, wantState: "up"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonServices := []services{
+				{Product: "Ingress", Type: "interactive", Aggregation: aggregationConfig{Strategy: strategyWeightedAverage, Threshold: tt.threshold}, Endpoints: endpointsOf("nginx-a", "nginx-b", "nginx-c", "nginx-d")},
+			}
+			mapKeyType, mapKeyEndpoint := createServicesMaps(jsonServices)
+			exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m"})
+			exporter.SetProductsConfig(createProductsConfig(jsonServices))
+			exporter.degradedEnabled = tt.degradedEnabled
+			exporter.degradedPropagation = propagateDegraded
+
+			var states strings.Builder
+			for _, state := range []string{"degraded", "down", "up"} {
+				value := 0
+				if state == tt.wantState {
+					value = 1
+				}
+				fmt.Fprintf(&states, "sa_service_state{cluster=\"\",namespace=\"\",product=\"Ingress\",state=%q} %d\n", state, value)
+			}
+			want := `
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Ingress"} ` + strconv.FormatFloat(tt.wantOverall, 'f', -1, 64) + `
+# HELP sa_service_state Overall Service Availability state of the product, 1 for its current state among up, degraded and down
+# TYPE sa_service_state gauge
+` + states.String() + `# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Ingress",type="interactive"} 0.75
+`
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_type", "sa_service_overall", "sa_service_state"); err != nil {
+				t.Errorf("Collect() unexpected metrics: %v", err)
+			}
+		})
+	}
+}
+
+// blackbox.go
+func TestBuildBlackboxQuery(t *testing.T) {
+	selector := BuildSelector("instance", serviceScope{Namespace: "car"}, endpointsOf("https://car.example.com", "tcp://kafka:9092"))
+	tests := []struct {
+		aggr string
+		want string
+	}{
+		{aggr: "", want: `min by (instance)(probe_success{instance=~"https://car.example.com|tcp://kafka:9092|",namespace=~"car"})`},
+		{aggr: "1m", want: `min by (instance)(max_over_time(probe_success{instance=~"https://car.example.com|tcp://kafka:9092|",namespace=~"car"}[1m]))`},
+	}
+
+	for _, tt := range tests {
+		if got := BuildBlackboxQuery("instance", selector, tt.aggr); got != tt.want {
+			t.Errorf("BuildBlackboxQuery(%q) = %q, want %q", tt.aggr, got, tt.want)
+		}
+	}
+}
+
+func TestExporterHitPromBlackbox(t *testing.T) {
+	kubernetes := kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{})
+	target := regexp.MustCompile(`target=~"([^"]*)"`)
+	probeSuccess := map[string]float64{"https://car.example.com": 1, "tcp://radio:9000": 0}
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		if !strings.Contains(query, "probe_success") {
+			return kubernetes(query)
+		}
+		var result []fakeSeries
+		for _, name := range strings.Split(target.FindStringSubmatch(query)[1], "|") {
+			if value, ok := probeSuccess[name]; ok {
+				result = append(result, fakeSeries{labels: map[string]string{"target": name}, value: value})
+			}
+		}
+		return result
+	})
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+		{Product: "Car", Type: "interactive", Source: sourceBlackbox, Endpoints: []serviceEndpoint{
+			{Name: "https://car.example.com"},
+			{Name: "tcp://radio:9000"},
+			{Name: "Wheel", Source: sourceKubernetes},
+		}},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.blackboxTargetLabel = "target"
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="https://car.example.com",namespace="",product="Car",type="interactive"} 1
+sa_service{cluster="",endpoint="tcp://radio:9000",namespace="",product="Car",type="interactive"} 0
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="Wheel",namespace="",product="Car",type="interactive"} 1
+sa_service_missing{cluster="",endpoint="https://car.example.com",namespace="",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="tcp://radio:9000",namespace="",product="Car",type="interactive"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service", "sa_service_missing"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromBlackboxSameEndpoint(t *testing.T) {
+	kubernetes := kubeEndpointAddress(map[string]float64{"web": 2, "batchsvc": 1}, map[string]float64{"web": 2})
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		if !strings.Contains(query, "probe_success") {
+			return kubernetes(query)
+		}
+		return []fakeSeries{{labels: map[string]string{"instance": "web"}, value: 1}}
+	})
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Probed", Type: "interactive", Source: sourceBlackbox, Endpoints: endpointsOf("web")},
+		{Product: "Shop", Type: "interactive", Endpoints: endpointsOf("web")},
+		{Product: "Other", Type: "batch", Endpoints: endpointsOf("batchsvc")},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="batchsvc",namespace="",product="Other",type="batch"} 1
+sa_service{cluster="",endpoint="web",namespace="",product="Probed",type="interactive"} 1
+sa_service{cluster="",endpoint="web",namespace="",product="Shop",type="interactive"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+// expression.go
+func TestRenderExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		endpoint   serviceEndpoint
+		want       string
+	}{
+		{
+			name:       "all placeholders",
+			expression: `avg_over_time(up{job="{{endpoint}}",namespace=~"{{ namespace }}",cluster=~"{{cluster}}"}[{{window}}])`,
+			endpoint:   serviceEndpoint{Name: "car-api", serviceScope: serviceScope{Namespace: "car", Cluster: "eu"}},
+			want:       `avg_over_time(up{job="car-api",namespace=~"car",cluster=~"eu"}[5m])`,
+		},
+		{
+			name:       "no scope",
+			expression: `min(up{job="{{endpoint}}",namespace=~"{{namespace}}",cluster=~"{{cluster}}"})`,
+			endpoint:   serviceEndpoint{Name: "car-api"},
+			want:       `min(up{job="car-api",namespace=~".*",cluster=~".*"})`,
+		},
+		{
+			name:       "no placeholder",
+			expression: `vector(1)`,
+			endpoint:   serviceEndpoint{Name: "car-api"},
+			want:       `vector(1)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RenderExpression(tt.expression, tt.endpoint, "5m"); got != tt.want {
+				t.Errorf("RenderExpression() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionValue(t *testing.T) {
+	sample := func(value float64) *model.Sample { return &model.Sample{Value: model.SampleValue(value)} }
+	tests := []struct {
+		name      string
+		data      model.Value
+		want      float64
+		wantFound bool
+	}{
+		{name: "empty vector", data: model.Vector{}, want: 0, wantFound: false},
+		{name: "lowest sample", data: model.Vector{sample(1), sample(0.75)}, want: 0.75, wantFound: true},
+		{name: "clamped", data: model.Vector{sample(3)}, want: 1, wantFound: true},
+		{name: "negative", data: model.Vector{sample(-1)}, want: 0, wantFound: true},
+		{name: "NaN", data: model.Vector{sample(math.NaN())}, want: 0, wantFound: true},
+		{name: "scalar", data: &model.Scalar{Value: 1}, want: 1, wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := ExpressionValue(tt.data)
+			if got != tt.want || found != tt.wantFound {
+				t.Errorf("ExpressionValue() = %v, %v, want %v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestExporterHitPromExpression(t *testing.T) {
+	kubernetes := kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{})
+	job := regexp.MustCompile(`job="([^"]*)"`)
+	up := map[string]float64{"car-api": 1, "car-db": 0.5}
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		if !strings.HasPrefix(query, "avg_over_time(up") {
+			return kubernetes(query)
+		}
+		if value, ok := up[job.FindStringSubmatch(query)[1]]; ok {
+			return []fakeSeries{{labels: map[string]string{}, value: value}}
+		}
+		return nil
+	})
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+		{Product: "Car", Type: "interactive", Expression: `avg_over_time(up{job="{{endpoint}}"}[{{window}}])`, Endpoints: endpointsOf("car-api", "car-db", "car-cache")},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="car-api",namespace="",product="Car",type="interactive"} 1
+sa_service{cluster="",endpoint="car-db",namespace="",product="Car",type="interactive"} 0.5
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="car-api",namespace="",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-cache",namespace="",product="Car",type="interactive"} 1
+sa_service_missing{cluster="",endpoint="car-db",namespace="",product="Car",type="interactive"} 0
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Car"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service", "sa_service_missing", "sa_service_overall"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+// workload.go
+func TestBuildWorkloadQuery(t *testing.T) {
+	selector := BuildSelector("deployment", serviceScope{Namespace: "car"}, endpointsOf("consumer-.*"))
+	tests := []struct {
+		aggr string
+		want string
+	}{
+		{aggr: "", want: `sum by (deployment)(kube_deployment_spec_replicas{deployment=~"consumer-.*|",namespace=~"car"})`},
+		{aggr: "5m", want: `sum by (deployment)(max_over_time(kube_deployment_spec_replicas{deployment=~"consumer-.*|",namespace=~"car"}[5m]))`},
+	}
+
+	for _, tt := range tests {
+		if got := BuildWorkloadQuery("deployment", "kube_deployment_spec_replicas", selector, tt.aggr); got != tt.want {
+			t.Errorf("BuildWorkloadQuery(%q) = %q, want %q", tt.aggr, got, tt.want)
+		}
+	}
+}
+
+func TestExporterHitPromWorkload(t *testing.T) {
+	kubernetes := kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{})
+	query := regexp.MustCompile(`^sum by \((\w+)\)\(max_over_time\((\w+)\{\w+=~"([^"]*)"`)
+	replicas := map[string]map[string]float64{
+		"kube_deployment_spec_replicas":                  {"consumer-orders": 3, "consumer-billing": 2},
+		"kube_deployment_status_replicas_available":      {"consumer-orders": 3, "consumer-billing": 1},
+		"kube_statefulset_replicas":                      {"kafka": 3},
+		"kube_statefulset_status_replicas_ready":         {"kafka": 0},
+		"kube_daemonset_status_desired_number_scheduled": {"log-shipper": 5},
+		"kube_daemonset_status_number_ready":             {"log-shipper": 5},
+	}
+	promURL := fakePrometheus(t, func(q string) []fakeSeries {
+		match := query.FindStringSubmatch(q)
+		if match == nil || match[1] == "endpoint" {
+			return kubernetes(q)
+		}
+		pattern := regexp.MustCompile("^(?:" + match[3] + ")$")
+		var result []fakeSeries
+		for name, value := range replicas[match[2]] {
+			if pattern.MatchString(name) {
+				result = append(result, fakeSeries{labels: map[string]string{match[1]: name}, value: value})
+			}
+		}
+		return result
+	})
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+			{Name: "Motor"},
+			{Name: "consumer-.*", Source: sourceDeployment, readyThreshold: readyThreshold{MinReadyRatio: 0.5}},
+			{Name: "kafka", Source: sourceStatefulSet},
+			{Name: "log-shipper", Source: sourceDaemonSet},
+			{Name: "cron-cleaner", Source: sourceDeployment},
+		}},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="consumer-billing",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="consumer-orders",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="kafka",namespace="",product="Car",type="batch"} 0
+sa_service{cluster="",endpoint="log-shipper",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="consumer-.*",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="cron-cleaner",namespace="",product="Car",type="batch"} 1
+sa_service_missing{cluster="",endpoint="kafka",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="log-shipper",namespace="",product="Car",type="batch"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service", "sa_service_missing"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestGetMetricSaWorkloadScopeReadyQueryFailed(t *testing.T) {
+	endpoints := []serviceEndpoint{{Name: "consumer-orders", Source: sourceDeployment}}
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{{Product: "Car", Type: "batch", Endpoints: endpoints}})
+	fake := &fakePromAPI{
+		results: func(query string) []fakeSeries {
+			return []fakeSeries{{labels: map[string]string{"deployment": "consumer-orders"}, value: 3}}
+		},
+		err:    fmt.Errorf("timeout"),
+		failOn: "kube_deployment_status_replicas_available",
+	}
+	exporter := NewExporter(fake, mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	if got := exporter.GetMetricSaWorkloadScope(sourceDeployment, "batch", "5m", serviceScope{}, mapKeyType["batch"]); got != nil {
+		t.Errorf("GetMetricSaWorkloadScope() = %+v, want no value when the ready query fails", got)
+	}
+	if len(fake.queries) != 2 {
+		t.Errorf("GetMetricSaWorkloadScope() queries = %v, want the desired and ready queries", fake.queries)
+	}
+}
+
+// endpointslice.go
+func TestBuildEndpointSliceQuery(t *testing.T) {
+	selector := BuildEndpointSliceSelector(serviceScope{Namespace: "car"}, endpointsOf("car-api", "kafka-.*"))
+	tests := []struct {
+		aggr string
+		want string
+	}{
+		{aggr: "", want: `count by (endpoint)(count by (cluster, namespace, endpoint, address)(label_replace(kube_endpointslice_endpoints{endpointslice=~"(?:car-api|kafka-.*|)-[a-z0-9]{5}",namespace=~"car"}, "endpoint", "$1", "endpointslice", "(.+)-[a-z0-9]{5}")))`},
+		{aggr: "1m", want: `count by (endpoint)(count by (cluster, namespace, endpoint, address)(label_replace(max_over_time(kube_endpointslice_endpoints{endpointslice=~"(?:car-api|kafka-.*|)-[a-z0-9]{5}",namespace=~"car"}[1m]), "endpoint", "$1", "endpointslice", "(.+)-[a-z0-9]{5}")))`},
+	}
+
+	for _, tt := range tests {
+		if got := BuildEndpointSliceQuery(selector, tt.aggr); got != tt.want {
+			t.Errorf("BuildEndpointSliceQuery(%q) = %q, want %q", tt.aggr, got, tt.want)
+		}
+	}
+}
+
+func TestGroupEndpointsBySource(t *testing.T) {
+	endpoints := []serviceEndpoint{{Name: "car-api"}, {Name: "kafka", Source: sourceKubernetes}, {Name: "car.example.com", Source: sourceBlackbox}}
+	tests := []struct {
+		name          string
+		defaultSource string
+		want          map[string][]serviceEndpoint
+	}{
+		{
+			name: "kubernetes by default",
+			want: map[string][]serviceEndpoint{
+				sourceKubernetes: {{Name: "car-api"}, {Name: "kafka", Source: sourceKubernetes}},
+				sourceBlackbox:   {{Name: "car.example.com", Source: sourceBlackbox}},
+			},
+		},
+		{
+			name:          "endpointslice globally",
+			defaultSource: sourceEndpointSlice,
+			want: map[string][]serviceEndpoint{
+				sourceEndpointSlice: {{Name: "car-api"}},
+				sourceKubernetes:    {{Name: "kafka", Source: sourceKubernetes}},
+				sourceBlackbox:      {{Name: "car.example.com", Source: sourceBlackbox}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GroupEndpointsBySource(endpoints, tt.defaultSource); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GroupEndpointsBySource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sliceAddress is a kube_endpointslice_endpoints series of an address with its ready, serving and terminating conditions
+type sliceAddress struct {
+	address, ready, serving, terminating string
+}
+
+// kubeEndpointSliceEndpoints answers the queries of the exporter like Prometheus would with these
+// kube_endpointslice_endpoints series seen during the window: the distinct addresses by service matching
+// the condition matchers of the query.
+func kubeEndpointSliceEndpoints(slices map[string][]sliceAddress) func(query string) []fakeSeries {
+	matchers := regexp.MustCompile(`(ready|serving|terminating)="(\w+)"`)
+	return func(query string) []fakeSeries {
+		var result []fakeSeries
+		for endpoint, series := range slices {
+			addresses := make(map[string]bool)
+			for _, s := range series {
+				conditions := map[string]string{"ready": s.ready, "serving": s.serving, "terminating": s.terminating}
+				matching := true
+				for _, match := range matchers.FindAllStringSubmatch(query, -1) {
+					matching = matching && conditions[match[1]] == match[2]
+				}
+				if matching {
+					addresses[s.address] = true
+				}
+			}
+			if len(addresses) > 0 {
+				result = append(result, fakeSeries{labels: map[string]string{"endpoint": endpoint}, value: float64(len(addresses))})
+			}
+		}
+		return result
+	}
+}
+
+func TestExporterHitPromEndpointSlice(t *testing.T) {
+	kubernetes := kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{})
+	slices := kubeEndpointSliceEndpoints(map[string][]sliceAddress{
+		"car-api": {
+			{"10.0.0.1", "true", "true", "false"},
+			{"10.0.0.2", "true", "true", "false"},
+			{"10.0.0.3", "false", "true", "true"},
+		},
+		"car-db": {
+			{"10.0.1.1", "false", "true", "true"},
+			{"10.0.1.2", "false", "true", "true"},
+		},
+		"car-cache": {
+			{"10.0.2.1", "false", "false", "false"},
+		},
+	})
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		if !strings.Contains(query, "kube_endpointslice_endpoints") {
+			return kubernetes(query)
+		}
+		return slices(query)
+	})
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Source: sourceKubernetes, Endpoints: endpointsOf("Motor")},
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("car-api", "car-db", "car-cache", "car-search")},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.defaultSource = sourceEndpointSlice
+	exporter.degradedEnabled = true
+
+	want := `
+# HELP sa_endpoint_addresses_ready Number of ready addresses of an endpoint, aggr on the window of its type
+# TYPE sa_endpoint_addresses_ready gauge
+sa_endpoint_addresses_ready{cluster="",endpoint="Motor",namespace="",type="batch"} 1
+sa_endpoint_addresses_ready{cluster="",endpoint="car-api",namespace="",type="interactive"} 2
+sa_endpoint_addresses_ready{cluster="",endpoint="car-cache",namespace="",type="interactive"} 0
+sa_endpoint_addresses_ready{cluster="",endpoint="car-db",namespace="",type="interactive"} 0
+# HELP sa_endpoint_addresses_terminating Number of serving but terminating addresses of an endpoint of the endpointslice source, aggr on the window of its type
+# TYPE sa_endpoint_addresses_terminating gauge
+sa_endpoint_addresses_terminating{cluster="",endpoint="car-api",namespace="",type="interactive"} 1
+sa_endpoint_addresses_terminating{cluster="",endpoint="car-cache",namespace="",type="interactive"} 0
+sa_endpoint_addresses_terminating{cluster="",endpoint="car-db",namespace="",type="interactive"} 2
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="car-api",namespace="",product="Car",type="interactive"} 1
+sa_service{cluster="",endpoint="car-cache",namespace="",product="Car",type="interactive"} 0
+sa_service{cluster="",endpoint="car-db",namespace="",product="Car",type="interactive"} 0.5
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="car-api",namespace="",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-cache",namespace="",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-db",namespace="",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-search",namespace="",product="Car",type="interactive"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_endpoint_addresses_ready", "sa_endpoint_addresses_terminating", "sa_service", "sa_service_missing"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromEndpointSliceReadyTransition(t *testing.T) {
+	// a rolling restart: the 3 addresses became ready during the window, each with one series per condition set
+	var addresses []sliceAddress
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		addresses = append(addresses, sliceAddress{address, "false", "false", "false"}, sliceAddress{address, "true", "true", "false"})
+	}
+	fake := &fakePromAPI{results: kubeEndpointSliceEndpoints(map[string][]sliceAddress{"api": addresses})}
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Shop", Type: "interactive", Source: sourceEndpointSlice, readyThreshold: readyThreshold{MinReadyRatio: 1}, Endpoints: endpointsOf("api")},
+	})
+	exporter := NewExporter(fake, mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m"})
+
+	want := []ProductTypeEndpointValue{{Product: "Shop", Type: "interactive", Endpoint: "api", Value: 1, Weight: 1, Source: sourceEndpointSlice, Ready: 3, Total: 3}}
+	if got := exporter.GetMetricSaEndpointSliceScope("interactive", "1m", serviceScope{}, mapKeyType["interactive"]); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMetricSaEndpointSliceScope() = %+v, want %+v", got, want)
+	}
+}
+
+// discovery.go
+func TestDiscoverServices(t *testing.T) {
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		switch query {
+		case discoveryLabelsQuery:
+			return []fakeSeries{
+				{labels: map[string]string{"namespace": "car", "service": "car-api", "label_sa_product": "Car", "label_sa_type": "interactive"}},
+				{labels: map[string]string{"namespace": "car", "service": "car-db", "label_sa_product": "Car", "label_sa_type": "batch"}},
+				{labels: map[string]string{"namespace": "car", "service": "car-cron", "label_sa_product": "Car", "label_sa_type": "cron"}},
+			}
+		case discoveryAnnotationsQuery:
+			return []fakeSeries{
+				{labels: map[string]string{"namespace": "car", "service": "car-api", "annotation_sa_product": "Truck", "annotation_sa_type": "batch"}},
+				{labels: map[string]string{"namespace": "boat", "service": "boat-api", "cluster": "eu-1", "annotation_sa_product": "Boat", "annotation_sa_type": "interactive"}},
+				{labels: map[string]string{"namespace": "boat", "service": "boat-radio", "annotation_sa_product": "Boat"}},
+			}
+		}
+		return nil
+	})
+
+	got, err := DiscoverServices(newPromClient(promURL, defaultPromTimeout), []string{"batch", "interactive"})
+	if err != nil {
+		t.Fatalf("DiscoverServices() unexpected error: %v", err)
+	}
+	want := []discoveredService{
+		{Product: "Boat", Type: "interactive", Endpoint: "boat-api", Namespace: "boat", Cluster: "eu-1"},
+		{Product: "Car", Type: "batch", Endpoint: "car-db", Namespace: "car"},
+		{Product: "Car", Type: "interactive", Endpoint: "car-api", Namespace: "car"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiscoverServices() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeDiscoveredServices(t *testing.T) {
+	static := []services{
+		{Product: "Car", Type: "interactive", serviceScope: serviceScope{Namespace: "car"}, Endpoints: endpointsOf("car-api")},
+	}
+	discovered := []discoveredService{
+		{Product: "Car", Type: "batch", Endpoint: "car.db", Namespace: "car"},
+		{Product: "Car", Type: "batch", Endpoint: "car-queue", Namespace: "car"},
+		{Product: "Truck", Type: "interactive", Endpoint: "car-api", Namespace: "car"},
+		{Product: "Truck", Type: "interactive", Endpoint: "car-api", Namespace: "truck"},
+	}
+
+	got, overridden := MergeDiscoveredServices(static, discovered)
+	want := []services{
+		static[0],
+		{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+			{Name: `car\.db`, serviceScope: serviceScope{Namespace: "car"}},
+			{Name: "car-queue", serviceScope: serviceScope{Namespace: "car"}},
+		}},
+		{Product: "Truck", Type: "interactive", Endpoints: []serviceEndpoint{
+			{Name: "car-api", serviceScope: serviceScope{Namespace: "truck"}},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeDiscoveredServices() = %v, want %v", got, want)
+	}
+	wantOverridden := []discoveredService{{Product: "Truck", Type: "interactive", Endpoint: "car-api", Namespace: "car"}}
+	if !reflect.DeepEqual(overridden, wantOverridden) {
+		t.Errorf("MergeDiscoveredServices() overridden = %v, want %v", overridden, wantOverridden)
+	}
+}
+
+func TestExporterSetDiscoveredServices(t *testing.T) {
+	static := []services{{Product: "Car", Type: "interactive", Endpoints: endpointsOf("car-api")}}
+	mapKeyType, mapKeyEndpoint := createServicesMaps(static)
+	exporter := NewExporter(newPromClient("http://localhost:9090", defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.staticServices = static
+
+	discovered := []discoveredService{{Product: "Boat", Type: "batch", Endpoint: "boat-api", Namespace: "boat"}}
+	boatAPI := serviceEndpoint{Name: "boat-api", serviceScope: serviceScope{Namespace: "boat"}}
+	exporter.SetDiscoveredServices(discovered, nil)
+	if _, got := exporter.ServicesMaps(); !reflect.DeepEqual(got[boatAPI], []string{"Boat"}) {
+		t.Errorf("SetDiscoveredServices() products of boat-api = %v, want [Boat]", got[boatAPI])
+	}
+
+	//a failed discovery keeps the services of the previous one
+	exporter.SetDiscoveredServices(nil, fmt.Errorf("prometheus unreachable"))
+	if _, got := exporter.ServicesMaps(); !reflect.DeepEqual(got[boatAPI], []string{"Boat"}) {
+		t.Errorf("SetDiscoveredServices() with error products of boat-api = %v, want [Boat]", got[boatAPI])
+	}
+	status := exporter.DiscoveryStatus()
+	if status.Error != "prometheus unreachable" || !reflect.DeepEqual(status.Discovered, discovered) {
+		t.Errorf("DiscoveryStatus() = %+v, want the error and the previous services", status)
+	}
+
+	//a reload of the static service map keeps the discovered services
+	exporter.SetStaticServices([]services{{Product: "Car", Type: "interactive", Endpoints: endpointsOf("car-web")}})
+	_, got := exporter.ServicesMaps()
+	if !reflect.DeepEqual(got[boatAPI], []string{"Boat"}) || !reflect.DeepEqual(got[serviceEndpoint{Name: "car-web"}], []string{"Car"}) {
+		t.Errorf("SetStaticServices() mapKeyEndpoint = %v, want car-web and boat-api", got)
+	}
+}
+
+func TestDiscoveryHandler(t *testing.T) {
+	exporter := NewExporter(newPromClient("http://localhost:9090", defaultPromTimeout), nil, nil, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.staticServices = []services{{Product: "Car", Type: "interactive", Endpoints: endpointsOf("car-api")}}
+	exporter.SetDiscoveredServices([]discoveredService{
+		{Product: "Boat", Type: "batch", Endpoint: "boat-api", Namespace: "boat"},
+		{Product: "Truck", Type: "batch", Endpoint: "car-api", Namespace: "car"},
+	}, nil)
+
+	rec := httptest.NewRecorder()
+	discoveryHandler(exporter)(rec, httptest.NewRequest(http.MethodGet, "/discovery", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("discoveryHandler() status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got discoveryStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("discoveryHandler() body is not JSON: %v", err)
+	}
+	if len(got.Discovered) != 2 || !reflect.DeepEqual(got.Overridden, []discoveredService{{Product: "Truck", Type: "batch", Endpoint: "car-api", Namespace: "car"}}) {
+		t.Errorf("discoveryHandler() = %+v, want 2 discovered services and car-api overridden", got)
+	}
+}
+
+// kube.go
+
+// kubeService returns a service and its EndpointSlice with one address per condition.
+func kubeService(namespace string, name string, conditions ...discoveryv1.EndpointConditions) []kuberuntime.Object {
+	slice := &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name + "-x7k2p", Labels: map[string]string{discoveryv1.LabelServiceName: name}}}
+	for i, condition := range conditions {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{fmt.Sprintf("10.0.0.%d", i+1)}, Conditions: condition})
+	}
+	return []kuberuntime.Object{&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, slice}
+}
+
+// startKubeWatcher returns a synced watcher of a fake cluster with these objects
+func startKubeWatcher(t *testing.T, objects ...kuberuntime.Object) *kubeWatcher {
+	watcher := newKubeWatcher(fake.NewSimpleClientset(objects...), 0)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	watcher.Start(stopCh)
+	if !watcher.WaitForSync(stopCh) {
+		t.Fatal("kubeWatcher not synced")
+	}
+	return watcher
+}
+
+func TestKubeWatcherEndpoints(t *testing.T) {
+	yes, no := true, false
+	ready := discoveryv1.EndpointConditions{Ready: &yes, Serving: &yes, Terminating: &no}
+	notReady := discoveryv1.EndpointConditions{Ready: &no, Serving: &no, Terminating: &no}
+	terminating := discoveryv1.EndpointConditions{Ready: &no, Serving: &yes, Terminating: &yes}
+
+	var objects []kuberuntime.Object
+	objects = append(objects, kubeService("car", "car-api", ready, ready, terminating)...)
+	objects = append(objects, kubeService("car", "car-db", notReady, discoveryv1.EndpointConditions{})...)
+	objects = append(objects,
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "legacy", Name: "radio"}},
+		&corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "legacy", Name: "radio"}, Subsets: []corev1.EndpointSubset{{
+			Addresses:         []corev1.EndpointAddress{{IP: "10.0.1.1"}},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.1.2"}, {IP: "10.0.1.3"}},
+		}}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "legacy", Name: "empty"}},
+	)
+	watcher := startKubeWatcher(t, objects...)
+
+	got, err := watcher.Endpoints()
+	if err != nil {
+		t.Fatalf("Endpoints() unexpected error: %v", err)
+	}
+	want := []kubeEndpoint{
+		{Namespace: "car", Name: "car-api", endpointAddresses: endpointAddresses{Ready: 2, Total: 3, Terminating: 1}},
+		{Namespace: "car", Name: "car-db", endpointAddresses: endpointAddresses{Ready: 1, Total: 2}},
+		{Namespace: "legacy", Name: "empty"},
+		{Namespace: "legacy", Name: "radio", endpointAddresses: endpointAddresses{Ready: 1, Total: 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Endpoints() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExporterCollectKubernetes(t *testing.T) {
+	yes, no := true, false
+	ready := discoveryv1.EndpointConditions{Ready: &yes, Serving: &yes, Terminating: &no}
+	notReady := discoveryv1.EndpointConditions{Ready: &no, Serving: &no, Terminating: &no}
+
+	var objects []kuberuntime.Object
+	objects = append(objects, kubeService("car", "car-api", ready, ready)...)
+	objects = append(objects, kubeService("car", "car-db", ready, notReady, notReady)...)
+	objects = append(objects, kubeService("boat", "car-db", ready)...)
+	objects = append(objects, kubeService("car", "car-cache", notReady)...)
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "interactive", serviceScope: serviceScope{Namespace: "car"}, Endpoints: []serviceEndpoint{
+			{Name: "car-api"},
+			{Name: "car-db", readyThreshold: readyThreshold{MinReadyRatio: 0.5}},
+			{Name: "car-cache"},
+			{Name: "car-search", Source: sourceEndpointSlice},
+		}},
+	})
+	//Prometheus is not needed for the Kubernetes sources
+	exporter := NewExporter(newPromClient("http://localhost:1", defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.kubeWatcher = startKubeWatcher(t, objects...)
+
+	want := `
+# HELP sa_prom_up Was the dependancy up
+# TYPE sa_prom_up gauge
+sa_prom_up{dependancy="kubernetes"} 1
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="car-api",namespace="car",product="Car",type="interactive"} 1
+sa_service{cluster="",endpoint="car-cache",namespace="car",product="Car",type="interactive"} 0
+sa_service{cluster="",endpoint="car-db",namespace="car",product="Car",type="interactive"} 0
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="car-api",namespace="car",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-cache",namespace="car",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-db",namespace="car",product="Car",type="interactive"} 0
+sa_service_missing{cluster="",endpoint="car-search",namespace="car",product="Car",type="interactive"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_prom_up", "sa_service", "sa_service_missing"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterCollectKubernetesNotSynced(t *testing.T) {
+	exporter := NewExporter(newPromClient("http://localhost:1", defaultPromTimeout), nil, nil, map[string]string{"interactive": "1m"})
+	//the informers are not started
+	exporter.kubeWatcher = newKubeWatcher(fake.NewSimpleClientset(), 0)
+
+	want := `
+# HELP sa_prom_up Was the dependancy up
+# TYPE sa_prom_up gauge
+sa_prom_up{dependancy="kubernetes"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_prom_up"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+// evaluation.go
+func TestExporterCollectBackground(t *testing.T) {
+	var queries int32
+	kubernetes := kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{})
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		atomic.AddInt32(&queries, 1)
+		return kubernetes(query)
+	})
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")}})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+	exporter.backgroundEvaluation = true
+
+	//nothing is evaluated by the scrapes, before the first evaluation there is no SA
+	if got := testutil.CollectAndCount(exporter, "sa_service"); got != 0 {
+		t.Errorf("Collect() before the first evaluation returned %d sa_service, want 0", got)
+	}
+	if got := testutil.ToFloat64(collectorOf(exporter, "sa_last_evaluation_timestamp_seconds")); got != 0 {
+		t.Errorf("sa_last_evaluation_timestamp_seconds before the first evaluation = %v, want 0", got)
+	}
+	if got := atomic.LoadInt32(&queries); got != 0 {
+		t.Errorf("Collect() in background mode queried Prometheus %d times, want 0", got)
+	}
+
+	before := time.Now()
+	exporter.Evaluate()
+	evaluated := atomic.LoadInt32(&queries)
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+`
+	for i := 0; i < 2; i++ {
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service"); err != nil {
+			t.Errorf("Collect() unexpected metrics: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != evaluated {
+		t.Errorf("Collect() of the snapshot queried Prometheus %d times, want 0", got-evaluated)
+	}
+	if got := testutil.ToFloat64(collectorOf(exporter, "sa_last_evaluation_timestamp_seconds")); got < float64(before.Unix()) {
+		t.Errorf("sa_last_evaluation_timestamp_seconds = %v, want after %v", got, before.Unix())
+	}
+}
+
+func TestExporterCollectEvaluationMetrics(t *testing.T) {
+	promURL := fakePrometheus(t, kubeEndpointAddress(map[string]float64{"Motor": 1}, map[string]float64{}))
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")}})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	//every scrape evaluates the SA when not in background mode
+	before := time.Now()
+	if got := testutil.ToFloat64(collectorOf(exporter, "sa_last_evaluation_timestamp_seconds")); got < float64(before.Unix()) {
+		t.Errorf("sa_last_evaluation_timestamp_seconds = %v, want after %v", got, before.Unix())
+	}
+	if got := testutil.ToFloat64(collectorOf(exporter, "sa_evaluation_duration_seconds")); got <= 0 {
+		t.Errorf("sa_evaluation_duration_seconds = %v, want > 0", got)
+	}
+}
+
+// collectorOf returns a collector of the single metric of exporter with that name
+func collectorOf(exporter *Exporter, name string) prometheus.Collector {
+	return metricFilter{exporter: exporter, name: name}
+}
+
+// metricFilter is a collector keeping only the metrics of one name of an exporter
+type metricFilter struct {
+	exporter *Exporter
+	name     string
+}
+
+func (f metricFilter) Describe(ch chan<- *prometheus.Desc) {
+	f.exporter.Describe(ch)
+}
+
+func (f metricFilter) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		f.exporter.Collect(metrics)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		if strings.Contains(metric.Desc().String(), `fqName: "`+f.name+`"`) {
+			ch <- metric
+		}
+	}
+}
+
+// graph.go
+func TestProductDependencyUnmarshalJSON(t *testing.T) {
+	var got []services
+	data := `[{"product":"Metrics","type":"batch","depends_on":["Auth",{"product":"Logs","soft":true}],"endpoints":["grafana"]}]`
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	want := []productDependency{{Product: "Auth"}, {Product: "Logs", Soft: true}}
+	if !reflect.DeepEqual(got[0].DependsOn, want) {
+		t.Errorf("json.Unmarshal() depends_on = %+v, want %+v", got[0].DependsOn, want)
+	}
+}
+
+func TestFindDependencyCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph map[string][]productDependency
+		want  []string
+	}{
+		{
+			name:  "no cycle",
+			graph: map[string][]productDependency{"Metrics": {{Product: "Auth"}, {Product: "Logs"}}, "Logs": {{Product: "Auth"}}, "Auth": nil},
+		},
+		{
+			name:  "cycle",
+			graph: map[string][]productDependency{"Metrics": {{Product: "Auth"}}, "Auth": {{Product: "Logs"}}, "Logs": {{Product: "Auth", Soft: true}}},
+			want:  []string{"Auth", "Logs", "Auth"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findDependencyCycle(tt.graph); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findDependencyCycle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadServiceMapDependencies(t *testing.T) {
+	dir := writeServiceMap(t, `[
+		{"product":"Auth","type":"batch","depends_on":["Metrics"],"endpoints":["keycloak"]},
+		{"product":"Metrics","type":"batch","depends_on":["Auth","Billing"],"endpoints":["grafana"]}
+	]`)
+
+	_, err := loadServiceMap(testServiceMapConfig(dir))
+	want := `the service map is not valid:
+  - product "Metrics" depends on the unknown product "Billing"
+  - dependency cycle Auth -> Metrics -> Auth`
+	if err == nil || err.Error() != want {
+		t.Errorf("loadServiceMap() error = %v, want %v", err, want)
+	}
+}
+
+func TestEffectiveValues(t *testing.T) {
+	graph := map[string][]productDependency{
+		"Metrics": {{Product: "Auth"}, {Product: "Logs", Soft: true}},
+		"Alerts":  {{Product: "Metrics"}},
+		"Logs":    {{Product: "Auth", Soft: true}},
+	}
+
+	tests := []struct {
+		name          string
+		overall       map[string]float64
+		optionalFloor float64
+		want          map[string]float64
+	}{
+		{
+			name:          "hard dependency down",
+			overall:       map[string]float64{"Auth": 0, "Metrics": 1, "Alerts": 1, "Logs": 1},
+			optionalFloor: saUp,
+			want:          map[string]float64{"Auth": 0, "Metrics": 0, "Alerts": 0, "Logs": 1},
+		},
+		{
+			name:          "soft dependency down",
+			overall:       map[string]float64{"Auth": 1, "Metrics": 1, "Alerts": 1, "Logs": 0},
+			optionalFloor: saDegraded,
+			want:          map[string]float64{"Auth": 1, "Metrics": 0.5, "Alerts": 0.5, "Logs": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EffectiveValues(tt.overall, graph, tt.optionalFloor); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EffectiveValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExporterHitPromEffective(t *testing.T) {
+	jsonServices := []services{
+		{Product: "Auth", Type: "batch", Endpoints: endpointsOf("keycloak")},
+		{Product: "Metrics", Type: "batch", DependsOn: []productDependency{{Product: "Auth"}}, Endpoints: endpointsOf("grafana")},
+	}
+	mapKeyType, mapKeyEndpoint := createServicesMaps(jsonServices)
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"keycloak": 1, "grafana": 1},
+		map[string]float64{"keycloak": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+	exporter.SetProductsConfig(createProductsConfig(jsonServices))
+
+	want := `
+# HELP sa_service_effective Overall Service Availability lowered by the one of the products depended on, down if any hard dependency is down
+# TYPE sa_service_effective gauge
+sa_service_effective{cluster="",namespace="",product="Auth"} 0
+sa_service_effective{cluster="",namespace="",product="Metrics"} 0
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Auth"} 0
+sa_service_overall{cluster="",namespace="",product="Metrics"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_overall", "sa_service_effective"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromEffectiveThreshold(t *testing.T) {
+	overallAggregation := aggregationConfig{Strategy: strategyWeightedAverage, Threshold: 0.75}
+	jsonServices := []services{
+		{Product: "Auth", Type: "batch", Weight: 4, OverallAggregation: overallAggregation, Endpoints: endpointsOf("keycloak")},
+		{Product: "Auth", Type: "interactive", Weight: 1, OverallAggregation: overallAggregation, Endpoints: endpointsOf("auth-api")},
+		{Product: "Metrics", Type: "batch", DependsOn: []productDependency{{Product: "Auth"}}, Endpoints: endpointsOf("grafana")},
+	}
+	mapKeyType, mapKeyEndpoint := createServicesMaps(jsonServices)
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"keycloak": 1, "auth-api": 1, "grafana": 1},
+		map[string]float64{"auth-api": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+	exporter.SetProductsConfig(createProductsConfig(jsonServices))
+
+	// Auth is at 0.8, above its threshold, so Metrics is not lowered by it
+	want := `
+# HELP sa_service_effective Overall Service Availability lowered by the one of the products depended on, down if any hard dependency is down
+# TYPE sa_service_effective gauge
+sa_service_effective{cluster="",namespace="",product="Auth"} 1
+sa_service_effective{cluster="",namespace="",product="Metrics"} 1
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Auth"} 0.8
+sa_service_overall{cluster="",namespace="",product="Metrics"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_overall", "sa_service_effective"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestGraphHandler(t *testing.T) {
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
+	exporter.SetProductsConfig(createProductsConfig([]services{
+		{Product: "Auth", Type: "batch", Endpoints: endpointsOf("keycloak")},
+		{Product: "Metrics", Type: "batch", DependsOn: []productDependency{{Product: "Auth"}, {Product: "Logs", Soft: true}}, Endpoints: endpointsOf("grafana")},
+		{Product: "Logs", Type: "batch", Endpoints: endpointsOf("loki")},
+	}))
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "json",
+			url:  "/graph",
+			want: `{"products":["Auth","Logs","Metrics"],"dependencies":[{"from":"Metrics","to":"Auth","soft":false},{"from":"Metrics","to":"Logs","soft":true}]}` + "\n",
+		},
+		{
+			name: "dot",
+			url:  "/graph?format=dot",
+			want: `digraph products {
+  "Auth";
+  "Logs";
+  "Metrics";
+  "Metrics" -> "Auth";
+  "Metrics" -> "Logs" [style=dashed];
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			graphHandler(exporter)(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Body.String() != tt.want {
+				t.Errorf("graphHandler() body = %q, want %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// unmapped.go
+func TestIsMappedEndpoint(t *testing.T) {
+	mapKeyType := map[string][]serviceEndpoint{
+		"interactive": endpointsOf("grafana"),
+		"batch": {
+			{Name: "prometheus-.*", serviceScope: serviceScope{Namespace: "monitoring"}},
+			{Name: "kube-state-metrics", serviceScope: serviceScope{Namespace: "kube-system", Cluster: "eu-1"}},
+			{Name: "car.example.com", Source: sourceBlackbox},
+			{Name: "kafka-.*", Source: sourceEndpointSlice},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		endpoint UnmappedEndpoint
+		want     bool
+	}{
+		{name: "unscoped", endpoint: UnmappedEndpoint{Namespace: "any", Endpoint: "grafana"}, want: true},
+		{name: "regex in namespace", endpoint: UnmappedEndpoint{Namespace: "monitoring", Endpoint: "prometheus-server"}, want: true},
+		{name: "other namespace", endpoint: UnmappedEndpoint{Namespace: "default", Endpoint: "prometheus-server"}, want: false},
+		{name: "anchored name", endpoint: UnmappedEndpoint{Namespace: "any", Endpoint: "grafana-agent"}, want: false},
+		{name: "cluster not checked", endpoint: UnmappedEndpoint{Namespace: "kube-system", Endpoint: "kube-state-metrics"}, want: true},
+		{name: "unknown", endpoint: UnmappedEndpoint{Namespace: "default", Endpoint: "kafka"}, want: false},
+		{name: "blackbox target", endpoint: UnmappedEndpoint{Namespace: "default", Endpoint: "car.example.com"}, want: false},
+		{name: "endpointslice service", endpoint: UnmappedEndpoint{Namespace: "default", Endpoint: "kafka-broker"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsMappedEndpoint(tt.endpoint, mapKeyType); got != tt.want {
+				t.Errorf("IsMappedEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// kubeEndpoints answers the unmapped endpoints query with these namespace/endpoint series
+func kubeEndpoints(t *testing.T, wantQuery string, endpoints []UnmappedEndpoint) func(query string) []fakeSeries {
+	return func(query string) []fakeSeries {
+		if query == "up{job=\"prometheus\"}" || !strings.HasPrefix(query, "count by (namespace, endpoint)") {
+			return nil
+		}
+		if query != wantQuery {
+			t.Errorf("unmapped endpoints query = %q, want %q", query, wantQuery)
+		}
+		var result []fakeSeries
+		for _, endpoint := range endpoints {
+			result = append(result, fakeSeries{labels: map[string]string{"namespace": endpoint.Namespace, "endpoint": endpoint.Endpoint}, value: 1})
+		}
+		return result
+	}
+}
+
+func TestGetUnmappedEndpoints(t *testing.T) {
+	promURL := fakePrometheus(t, kubeEndpoints(t, `count by (namespace, endpoint)(kube_endpoint_address{namespace=~"team-.*"})`, []UnmappedEndpoint{
+		{Namespace: "team-b", Endpoint: "kafka"},
+		{Namespace: "team-a", Endpoint: "grafana"},
+		{Namespace: "team-a", Endpoint: "redis"},
+	}))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), map[string][]serviceEndpoint{"interactive": endpointsOf("grafana")}, nil, nil)
+	exporter.unmappedNamespace = "team-.*"
+
+	got, err := exporter.GetUnmappedEndpoints()
+	if err != nil {
+		t.Fatalf("GetUnmappedEndpoints() error = %v", err)
+	}
+	want := []UnmappedEndpoint{{Namespace: "team-a", Endpoint: "redis"}, {Namespace: "team-b", Endpoint: "kafka"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetUnmappedEndpoints() = %v, want %v", got, want)
+	}
+
+	exporter.unmappedEnabled = true
+	wantMetrics := `
+# HELP sa_unmapped_endpoint Kubernetes endpoint not mapped to any product
+# TYPE sa_unmapped_endpoint gauge
+sa_unmapped_endpoint{endpoint="kafka",namespace="team-b"} 1
+sa_unmapped_endpoint{endpoint="redis",namespace="team-a"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(wantMetrics), "sa_unmapped_endpoint"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestUnmappedHandler(t *testing.T) {
+	promURL := fakePrometheus(t, kubeEndpoints(t, `count by (namespace, endpoint)(kube_endpoint_address{})`, []UnmappedEndpoint{
+		{Namespace: "default", Endpoint: "kafka"},
+	}))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	unmappedHandler(exporter)(rec, httptest.NewRequest(http.MethodGet, "/unmapped", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unmappedHandler() status = %v, want %v", rec.Code, http.StatusOK)
+	}
+	want := `[{"namespace":"default","endpoint":"kafka"}]` + "\n"
+	if rec.Body.String() != want {
+		t.Errorf("unmappedHandler() body = %q, want %q", rec.Body.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	unmappedHandler(NewExporter(newPromClient("http://unreachable:9090", defaultPromTimeout), nil, nil, nil))(rec, httptest.NewRequest(http.MethodGet, "/unmapped", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("unmappedHandler() status = %v for unreachable Prometheus, want %v", rec.Code, http.StatusBadGateway)
+	}
+}
+
+// probe.go
+func TestHTTPProber(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(`{"status":"UP"}`))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name   string
+		config httpProbeConfig
+		want   bool
+	}{
+		{name: "2xx by default", config: httpProbeConfig{URL: server.URL + "/health"}, want: true},
+		{name: "unexpected status", config: httpProbeConfig{URL: server.URL + "/broken"}, want: false},
+		{name: "expected status", config: httpProbeConfig{URL: server.URL + "/broken", StatusCodes: []int{200, 503}}, want: true},
+		{name: "body matching", config: httpProbeConfig{URL: server.URL, BodyRegex: `"status":"UP"`}, want: true},
+		{name: "body not matching", config: httpProbeConfig{URL: server.URL, BodyRegex: `"status":"DOWN"`}, want: false},
+		{name: "unknown certificate", config: httpProbeConfig{URL: tlsServer.URL}, want: false},
+		{name: "insecure skip verify", config: httpProbeConfig{URL: tlsServer.URL, TLS: tlsProbeConfig{InsecureSkipVerify: true}}, want: true},
+		{name: "unreachable", config: httpProbeConfig{URL: "http://127.0.0.1:1"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			got := runProbe(serviceEndpoint{Name: "test", Probe: &probeConfig{HTTP: &config, Timeout: "2s"}})
+			if got.Success != tt.want {
+				t.Errorf("runProbe() success = %v, want %v", got.Success, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCPProber(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	address := listener.Addr().String()
+
+	if got := runProbe(serviceEndpoint{Name: "kafka", Probe: &probeConfig{TCP: &tcpProbeConfig{Address: address}}}); !got.Success {
+		t.Errorf("runProbe() success = false for a listening port, want true")
+	}
+	listener.Close()
+	if got := runProbe(serviceEndpoint{Name: "kafka", Probe: &probeConfig{TCP: &tcpProbeConfig{Address: address}, Timeout: "1s"}}); got.Success {
+		t.Errorf("runProbe() success = true for a closed port, want false")
+	}
+}
+
+func TestGRPCProber(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("billing", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("invoicing", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	tests := []struct {
+		name    string
+		service string
+		want    bool
+	}{
+		{name: "server", service: "", want: true},
+		{name: "serving", service: "billing", want: true},
+		{name: "not serving", service: "invoicing", want: false},
+		{name: "unknown", service: "shipping", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe := &probeConfig{GRPC: &grpcProbeConfig{Address: listener.Addr().String(), Service: tt.service}, Timeout: "2s"}
+			if got := runProbe(serviceEndpoint{Name: "billing", Probe: probe}); got.Success != tt.want {
+				t.Errorf("runProbe() success = %v, want %v", got.Success, tt.want)
+			}
+		})
+	}
+}
+
+func TestCombineProbe(t *testing.T) {
+	tests := []struct {
+		combine    string
+		readyValue float64
+		probeValue float64
+		want       float64
+	}{
+		{combine: "", readyValue: 1, probeValue: 0, want: 0},
+		{combine: combineAnd, readyValue: 0.5, probeValue: 1, want: 0.5},
+		{combine: combineOr, readyValue: 0, probeValue: 1, want: 1},
+		{combine: combineProbe, readyValue: 1, probeValue: 0, want: 0},
+		{combine: combineNone, readyValue: 1, probeValue: 0, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := CombineProbe(tt.readyValue, tt.probeValue, tt.combine); got != tt.want {
+			t.Errorf("CombineProbe(%v, %v, %q) = %v, want %v", tt.readyValue, tt.probeValue, tt.combine, got, tt.want)
+		}
+	}
+}
+
+func TestExporterHitPromProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+			{Name: "Motor", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: server.URL + "/broken"}}},
+			{Name: "Tires", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: server.URL + "/health"}, Combine: combineOr}},
+			{Name: "Radio"},
+		}},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Motor": 1, "Tires": 1, "Radio": 1},
+		map[string]float64{"Tires": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	want := `
+# HELP sa_probe_success Whether the active probe of an endpoint was successful
+# TYPE sa_probe_success gauge
+sa_probe_success{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_probe_success{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service{cluster="",endpoint="Radio",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_probe_success", "sa_service"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromProbesMissing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{
+			{Name: "Motor", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: server.URL + "/health"}, Combine: combineProbe}},
+			{Name: "Tires", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: server.URL + "/health"}, Combine: combineOr}},
+			{Name: "Radio", Probe: &probeConfig{HTTP: &httpProbeConfig{URL: server.URL + "/health"}}},
+		}},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(map[string]float64{}, map[string]float64{}))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service", "sa_service_type"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+// reload.go
+
+// testServiceMapConfig returns the config loading the JSON files of dir
+func testServiceMapConfig(dir string) serviceMapConfig {
+	return serviceMapConfig{externalServicePath: dir, defaultServiceFile: "resources/services.json", pattern: "*.json"}
+}
+
+// writeServiceMap writes a service map file in a new temporary directory and returns the directory
+func writeServiceMap(t *testing.T, content string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
+	}
+	return dir
+}
+
+func TestReloadServices(t *testing.T) {
+	dir := writeServiceMap(t, `[{"product":"Plane","type":"batch","endpoints":["Engine"]}]`)
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
+
+	if err := reloadServices(exporter, testServiceMapConfig(dir)); err != nil {
+		t.Fatalf("reloadServices() error = %v", err)
+	}
+	_, mapKeyEndpoint := exporter.ServicesMaps()
+	if got := mapKeyEndpoint[serviceEndpoint{Name: "Engine"}]; !reflect.DeepEqual(got, []string{"Plane"}) {
+		t.Errorf("reloadServices() Engine products = %v, want [Plane]", got)
+	}
+	if !exporter.lastReloadSuccessful || exporter.lastReloadTimestamp.IsZero() {
+		t.Errorf("reloadServices() reload status = %v at %v, want successful", exporter.lastReloadSuccessful, exporter.lastReloadTimestamp)
+	}
+
+	// a broken service map must not replace the current one
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(`[{"product":`), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
+	}
+	if err := reloadServices(exporter, testServiceMapConfig(dir)); err == nil {
+		t.Error("reloadServices() expected error for invalid JSON but got nil")
+	}
+	_, mapKeyEndpoint = exporter.ServicesMaps()
+	if got := mapKeyEndpoint[serviceEndpoint{Name: "Engine"}]; !reflect.DeepEqual(got, []string{"Plane"}) {
+		t.Errorf("reloadServices() kept Engine products = %v, want [Plane]", got)
+	}
+	if exporter.lastReloadSuccessful {
+		t.Error("reloadServices() reload status successful after invalid JSON")
+	}
+
+	// an empty service map is considered as an error too
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(`[]`), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
+	}
+	if err := reloadServices(exporter, testServiceMapConfig(dir)); err == nil {
+		t.Error("reloadServices() expected error for empty service map but got nil")
+	}
+}
+
+func TestServicesFingerprint(t *testing.T) {
+	dir := writeServiceMap(t, `[{"product":"Plane","type":"batch","endpoints":["Engine"]}]`)
+
+	before, err := servicesFingerprint(testServiceMapConfig(dir))
+	if err != nil {
+		t.Fatalf("servicesFingerprint() error = %v", err)
+	}
+	same, _ := servicesFingerprint(testServiceMapConfig(dir))
+	if before != same {
+		t.Errorf("servicesFingerprint() = %q then %q for unchanged file", before, same)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(`[{"product":"Plane","type":"batch","endpoints":["Wings"]}]`), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
+	}
+	after, _ := servicesFingerprint(testServiceMapConfig(dir))
+	if before == after {
+		t.Error("servicesFingerprint() did not change after the file was modified")
+	}
+
+	if _, err := servicesFingerprint(serviceMapConfig{externalServicePath: "WRONG", defaultServiceFile: "non-existent.json", pattern: "*.json"}); err == nil {
+		t.Error("servicesFingerprint() expected error for missing file but got nil")
+	}
+}
+
+func TestWatchServices(t *testing.T) {
+	dir := writeServiceMap(t, `[{"product":"Plane","type":"batch","endpoints":["Engine"]}]`)
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
+
+	go watchServices(exporter, testServiceMapConfig(dir), 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(`[{"product":"Plane","type":"batch","endpoints":["Wings"]}]`), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		_, mapKeyEndpoint := exporter.ServicesMaps()
+		if _, ok := mapKeyEndpoint[serviceEndpoint{Name: "Wings"}]; ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("watchServices() did not reload the modified service map")
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir := writeServiceMap(t, `[{"product":"Plane","type":"batch","endpoints":["Engine"]}]`)
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
+	handler := reloadHandler(exporter, testServiceMapConfig(dir))
+
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+	}{
+		{name: "GET not allowed", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "POST reloads", method: http.MethodPost, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(tt.method, "/-/reload", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("reloadHandler() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
 
-func TestPromNoConnection_queryRange(t *testing.T) {
-	_, err := PromQueryRange("http://foo:9090", "up{job=\"prometheus\"}", time.Now().Add(-time.Hour), time.Now(), time.Minute)
-	if err == nil {
-		t.Error("TestPromNoConnection_queryRange() expected error but got nil")
+	if err := os.WriteFile(filepath.Join(dir, "services.json"), []byte(`{invalid json`), 0o644); err != nil {
+		t.Fatalf("Failed to write service map: %v", err)
 	}
-	// Just check that we get a connection error, don't check specific DNS resolver message
-	if !strings.Contains(err.Error(), "dial tcp") {
-		t.Errorf("TestPromNoConnection_queryRange() = %q, expected dial tcp error", err)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("reloadHandler() status = %v for invalid JSON, want %v", rec.Code, http.StatusInternalServerError)
 	}
 }
 
-func TestPromNoConnection_series(t *testing.T) {
-	_, err := PromSeries("http://foo:9090", "up{job=\"prometheus\"}", time.Now().Add(-time.Hour), time.Now())
-	if err == nil {
-		t.Error("TestPromNoConnection_series() expected error but got nil")
+//collector.go
+
+func TestExporterCollectConfigMetrics(t *testing.T) {
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
+	exporter.setReloadStatus(true)
+
+	ch := make(chan prometheus.Metric, 10)
+	exporter.CollectConfigMetrics(ch)
+	close(ch)
+
+	var descs []string
+	for metric := range ch {
+		descs = append(descs, metric.Desc().String())
 	}
-	// Just check that we get a connection error, don't check specific DNS resolver message
-	if !strings.Contains(err.Error(), "dial tcp") {
-		t.Errorf("TestPromNoConnection_series() = %q, expected dial tcp error", err)
+	want := []string{configLastReloadSuccessful.String(), configLastReloadTimestamp.String()}
+	if !reflect.DeepEqual(descs, want) {
+		t.Errorf("CollectConfigMetrics() = %v, want %v", descs, want)
 	}
 }
 
-//collector.go
-//not so much to test
-
 // collector_prom.go
 func TestBuildSaQueryEndpoints(t *testing.T) {
 	// Use test data from the actual test services
-	testMapKeyType := map[string][]string{
-		"interactive": {"my-svc"},
-		"batch":       {"my-2nd-svc", "my-3rd-svc", "my-4th-svc"},
+	testMapKeyType := map[string][]serviceEndpoint{
+		"interactive": endpointsOf("my-svc"),
+		"batch":       endpointsOf("my-2nd-svc", "my-3rd-svc", "my-4th-svc"),
 	}
 
 	want := "my-svc|"
-	got := BuildSaQueryEndpoints("interactive", testMapKeyType)
+	got := BuildSaQueryEndpoints(testMapKeyType["interactive"])
 
 	if got != want {
 		t.Errorf("BuildSaQueryEndpoints() = %q, want %q", got, want)
 	}
 
 	wantBatch := "my-2nd-svc|my-3rd-svc|my-4th-svc|"
-	gotBatch := BuildSaQueryEndpoints("batch", testMapKeyType)
+	gotBatch := BuildSaQueryEndpoints(testMapKeyType["batch"])
 
 	if gotBatch != wantBatch {
 		t.Errorf("BuildSaQueryEndpoints() batch = %q, want %q", gotBatch, wantBatch)
 	}
 }
 
-func TestFindProductsForEndpoint(t *testing.T) {
-	// Use test data that matches the actual test services
-	testMapKeyEndpoint := map[string][]string{
-		"Wheel": {"Car"},
-		"Tires": {"Car"},
+func TestBuildSaQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		aggr     string
+		want     string
+	}{
+		{
+			name:     "instant query without window",
+			selector: `endpoint=~"my-svc|"`,
+			aggr:     "",
+			want:     `count by (endpoint)(count by (cluster, namespace, endpoint, ip)(kube_endpoint_address{endpoint=~"my-svc|"}))`,
+		},
+		{
+			name:     "interactive window",
+			selector: `endpoint=~"my-svc|"`,
+			aggr:     "1m",
+			want:     `count by (endpoint)(count by (cluster, namespace, endpoint, ip)(max_over_time(kube_endpoint_address{endpoint=~"my-svc|"}[1m])))`,
+		},
+		{
+			name:     "batch window ready",
+			selector: `endpoint=~"my-svc|",ready="true"`,
+			aggr:     "5m",
+			want:     `count by (endpoint)(count by (cluster, namespace, endpoint, ip)(max_over_time(kube_endpoint_address{endpoint=~"my-svc|",ready="true"}[5m])))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildSaQuery(tt.selector, tt.aggr); got != tt.want {
+				t.Errorf("BuildSaQuery() = %v, want %v", got, tt.want)
+			}
+		})
 	}
+}
 
-	want := "Car"
-	got := FindProductsForEndpoint("Wheel", testMapKeyEndpoint)
+func TestGroupEndpointsByScope(t *testing.T) {
+	monitoring := serviceScope{Namespace: "monitoring"}
+	endpoints := []serviceEndpoint{
+		{Name: "grafana"},
+		{Name: "prometheus", serviceScope: monitoring},
+		{Name: "kibana"},
+		{Name: "alertmanager", serviceScope: monitoring},
+	}
 
-	if len(got) == 0 || got[0] != want {
-		t.Errorf("FindProductForEndpoint(Wheel) = %q, want %q", got, want)
+	got := GroupEndpointsByScope(endpoints)
+	want := map[serviceScope][]serviceEndpoint{
+		{}:         endpointsOf("grafana", "kibana"),
+		monitoring: {{Name: "prometheus", serviceScope: monitoring}, {Name: "alertmanager", serviceScope: monitoring}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupEndpointsByScope() = %v, want %v", got, want)
 	}
+}
 
-	got = FindProductsForEndpoint("Tires", testMapKeyEndpoint)
-	if len(got) == 0 || got[0] != want {
-		t.Errorf("FindProductsForEndpoint(Tires) = %q, want %q", got, want)
+func TestBuildSaSelector(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope serviceScope
+		want  string
+	}{
+		{
+			name:  "no scope",
+			scope: serviceScope{},
+			want:  `endpoint=~"grafana|prometheus|"`,
+		},
+		{
+			name:  "namespace",
+			scope: serviceScope{Namespace: "monitoring"},
+			want:  `endpoint=~"grafana|prometheus|",namespace=~"monitoring"`,
+		},
+		{
+			name:  "namespace and cluster",
+			scope: serviceScope{Namespace: "monitoring", Cluster: "eu-.*"},
+			want:  `endpoint=~"grafana|prometheus|",namespace=~"monitoring",cluster=~"eu-.*"`,
+		},
 	}
 
-	// Test non-existent endpoint
-	got = FindProductsForEndpoint("svc-foo", testMapKeyEndpoint)
-	if len(got) > 0 {
-		t.Errorf("FindProductForEndpoint(svc-foo) = %q, want empty slice", got)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildSaSelector(tt.scope, endpointsOf("grafana", "prometheus")); got != tt.want {
+				t.Errorf("BuildSaSelector() = %v, want %v", got, tt.want)
+			}
+		})
 	}
 }
 
-// use the mapped-services/test.json data to test
-func TestFindProductsForEndpointFromJSON(t *testing.T) {
-	// Use test data from the actual test services
-	svc := openServices("mapped-services/test.json")
-	mapKeyType, mapKeyEndpoint = createServicesMaps(svc)
+func TestFindScopeForProduct(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Metrics", Type: "interactive", serviceScope: serviceScope{Namespace: "monitoring", Cluster: "eu-1"}, Endpoints: endpointsOf("grafana")},
+		{Product: "Metrics", Type: "batch", serviceScope: serviceScope{Namespace: "kube-system", Cluster: "eu-1"}, Endpoints: endpointsOf("kube-state-metrics")},
+	})
+
+	tests := []struct {
+		name         string
+		typeEndpoint string
+		want         serviceScope
+	}{
+		{name: "interactive", typeEndpoint: "interactive", want: serviceScope{Namespace: "monitoring", Cluster: "eu-1"}},
+		{name: "batch", typeEndpoint: "batch", want: serviceScope{Namespace: "kube-system", Cluster: "eu-1"}},
+		{name: "overall keeps the shared cluster only", typeEndpoint: "", want: serviceScope{Cluster: "eu-1"}},
+		{name: "unknown type", typeEndpoint: "nonexistent", want: serviceScope{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FindScopeForProduct("Metrics", tt.typeEndpoint, mapKeyType, mapKeyEndpoint); got != tt.want {
+				t.Errorf("FindScopeForProduct() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
 
-	want := "Car"
-	got := FindProductsForEndpoint("Wheel", mapKeyEndpoint)
-	if len(got) == 0 || got[0] != want {
-		t.Errorf("TestFindProductsForEndpointFromJSON(tempo) = %q, want %q", got, want)
+func TestFindTypesForProduct(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel")},
+		{Product: "Car", Type: "storage", Endpoints: endpointsOf("Trunk")},
+		{Product: "Car", Type: "api", Endpoints: endpointsOf("Radio")},
+		{Product: "Plane", Type: "batch", Endpoints: endpointsOf("Engine")},
+	})
+
+	if got := FindTypesForProduct("Car", mapKeyType, mapKeyEndpoint); !reflect.DeepEqual(got, []string{"api", "interactive", "storage"}) {
+		t.Errorf("FindTypesForProduct(Car) = %v, want [api interactive storage]", got)
+	}
+	if got := FindTypesForProduct("Boat", mapKeyType, mapKeyEndpoint); got != nil {
+		t.Errorf("FindTypesForProduct(Boat) = %v, want nil", got)
 	}
+}
 
+func TestExporterHitPromCustomTypes(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel")},
+		{Product: "Car", Type: "api", Endpoints: endpointsOf("Radio", "Gps")},
+		{Product: "Plane", Type: "streaming", Endpoints: endpointsOf("Camera")},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Wheel": 4, "Radio": 2, "Gps": 1, "Camera": 1},
+		map[string]float64{"Gps": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "api": "2m", "streaming": "30s"})
+
+	want := `
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Car"} 0
+sa_service_overall{cluster="",namespace="",product="Plane"} 1
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="api"} 0
+sa_service_type{cluster="",namespace="",product="Car",type="interactive"} 1
+sa_service_type{cluster="",namespace="",product="Plane",type="streaming"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_type", "sa_service_overall"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
 }
 
 func TestFindProductsFromQueryResult(t *testing.T) {
@@ -228,6 +2680,261 @@ func TestFindProductsFromQueryResult(t *testing.T) {
 	}
 }
 
+func TestFindProductsFromServicesMap(t *testing.T) {
+	_, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel", "Gear")},
+		{Product: "Plane", Type: "interactive", Endpoints: endpointsOf("Wheel")},
+		{Product: "Boat", Type: "batch", Endpoints: endpointsOf("Sail")},
+	})
+
+	want := map[string]struct{}{"Car": {}, "Plane": {}, "Boat": {}}
+	if got := FindProductsFromServicesMap(mapKeyEndpoint); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindProductsFromServicesMap() = %v, want %v", got, want)
+	}
+}
+
+func TestSaTypeValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		valuesIn []weightedValue
+		want     float64
+	}{
+		{name: "no data", valuesIn: nil, want: 0.0},
+		{name: "all up", valuesIn: []weightedValue{{1.0, 1.0}, {1.0, 1.0}}, want: 1.0},
+		{name: "one down", valuesIn: []weightedValue{{1.0, 1.0}, {0.0, 1.0}}, want: 0.0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SaTypeValue(tt.valuesIn, allUp{propagation: propagateDegraded}, "test"); got != tt.want {
+				t.Errorf("SaTypeValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExporterHitPromProductsFromServicesMap(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Wheel")},
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")},
+		// interactive only product
+		{Product: "Plane", Type: "interactive", Endpoints: endpointsOf("Cockpit")},
+		// product without any series
+		{Product: "Boat", Type: "batch", Endpoints: endpointsOf("Sail")},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Wheel": 1, "Cockpit": 2},
+		map[string]float64{},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m", "batch": "5m"})
+
+	want := `
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Boat"} 0
+sa_service_overall{cluster="",namespace="",product="Car"} 0
+sa_service_overall{cluster="",namespace="",product="Plane"} 1
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Boat",type="batch"} 0
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 0
+sa_service_type{cluster="",namespace="",product="Car",type="interactive"} 1
+sa_service_type{cluster="",namespace="",product="Plane",type="interactive"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service_type", "sa_service_overall"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestFindMissingEndpoints(t *testing.T) {
+	endpoints := endpointsOf("Wheel", "Gear", "Tires-.*", "Motor")
+	found := map[string]float64{"Wheel": 1, "Tires-front": 2, "Motorbike": 1}
+
+	want := endpointsOf("Gear", "Motor")
+	if got := FindMissingEndpoints(endpoints, found); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindMissingEndpoints() = %v, want %v", got, want)
+	}
+}
+
+func TestExporterHitPromMissingEndpoints(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor", "Tires")},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Motor": 1},
+		map[string]float64{},
+	))
+
+	tests := []struct {
+		name          string
+		missingAsDown bool
+		want          string
+	}{
+		{
+			name:          "missing endpoint ignored",
+			missingAsDown: false,
+			want: `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 1
+`,
+		},
+		{
+			name:          "missing endpoint as down",
+			missingAsDown: true,
+			want: `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 0
+# HELP sa_service_missing Whether a configured endpoint has no series from its source, deleted or misspelled service
+# TYPE sa_service_missing gauge
+sa_service_missing{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service_missing{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 0
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+			exporter.missingAsDown = tt.missingAsDown
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(tt.want), "sa_service", "sa_service_missing", "sa_service_type"); err != nil {
+				t.Errorf("Collect() unexpected metrics: %v", err)
+			}
+		})
+	}
+}
+
+func TestThresholdReadyValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		ready     float64
+		total     float64
+		threshold readyThreshold
+		want      float64
+	}{
+		{name: "no threshold", ready: 1, total: 20, want: 1},
+		{name: "no threshold none ready", ready: 0, total: 20, want: 0},
+		{name: "min ready reached", ready: 3, total: 20, threshold: readyThreshold{MinReady: 3}, want: 1},
+		{name: "min ready not reached", ready: 2, total: 20, threshold: readyThreshold{MinReady: 3}, want: 0},
+		{name: "min ratio reached", ready: 10, total: 20, threshold: readyThreshold{MinReadyRatio: 0.5}, want: 1},
+		{name: "min ratio not reached", ready: 1, total: 20, threshold: readyThreshold{MinReadyRatio: 0.5}, want: 0},
+		{name: "both reached", ready: 4, total: 5, threshold: readyThreshold{MinReady: 3, MinReadyRatio: 0.8}, want: 1},
+		{name: "count reached ratio not", ready: 3, total: 5, threshold: readyThreshold{MinReady: 3, MinReadyRatio: 0.8}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ThresholdReadyValue(tt.ready, tt.total, tt.threshold); got != tt.want {
+				t.Errorf("ThresholdReadyValue(%v, %v, %+v) = %v, want %v", tt.ready, tt.total, tt.threshold, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExporterHitPromThreshold(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", readyThreshold: readyThreshold{MinReadyRatio: 0.5}, Endpoints: endpointsOf("Motor", "Tires-.*")},
+		{Product: "Plane", Type: "batch", Endpoints: endpointsOf("Motor")},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Motor": 20, "Tires-.*": 4},
+		map[string]float64{"Motor": 19, "Tires-.*": 1},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	want := `
+# HELP sa_endpoint_addresses_ready Number of ready addresses of an endpoint, aggr on the window of its type
+# TYPE sa_endpoint_addresses_ready gauge
+sa_endpoint_addresses_ready{cluster="",endpoint="Motor",namespace="",type="batch"} 1
+sa_endpoint_addresses_ready{cluster="",endpoint="Tires-.*",namespace="",type="batch"} 3
+# HELP sa_endpoint_addresses_total Number of addresses, ready or not, of an endpoint, aggr on the window of its type
+# TYPE sa_endpoint_addresses_total gauge
+sa_endpoint_addresses_total{cluster="",endpoint="Motor",namespace="",type="batch"} 20
+sa_endpoint_addresses_total{cluster="",endpoint="Tires-.*",namespace="",type="batch"} 4
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0
+sa_service{cluster="",endpoint="Motor",namespace="",product="Plane",type="batch"} 1
+sa_service{cluster="",endpoint="Tires-.*",namespace="",product="Car",type="batch"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_endpoint_addresses_ready", "sa_endpoint_addresses_total", "sa_service"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromReadyTransition(t *testing.T) {
+	// a rolling restart: the 3 addresses were not ready then ready during the window, each with one series per state
+	type addressSeries struct{ ip, ready string }
+	seen := []addressSeries{
+		{"10.0.0.1", "false"}, {"10.0.0.1", "true"},
+		{"10.0.0.2", "false"}, {"10.0.0.2", "true"},
+		{"10.0.0.3", "false"}, {"10.0.0.3", "true"},
+	}
+	promURL := fakePrometheus(t, func(query string) []fakeSeries {
+		if query == "up{job=\"prometheus\"}" {
+			return []fakeSeries{{labels: map[string]string{"job": "prometheus"}, value: 1}}
+		}
+		if !strings.Contains(query, "count by (cluster, namespace, endpoint, ip)") {
+			t.Errorf("query %q does not count the addresses by ip", query)
+		}
+		ips := make(map[string]bool)
+		for _, series := range seen {
+			if !strings.Contains(query, `ready="true"`) || series.ready == "true" {
+				ips[series.ip] = true
+			}
+		}
+		return []fakeSeries{{labels: map[string]string{"endpoint": "api"}, value: float64(len(ips))}}
+	})
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Shop", Type: "interactive", readyThreshold: readyThreshold{MinReadyRatio: 0.8}, Endpoints: endpointsOf("api")},
+	})
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"interactive": "1m"})
+
+	want := `
+# HELP sa_endpoint_addresses_ready Number of ready addresses of an endpoint, aggr on the window of its type
+# TYPE sa_endpoint_addresses_ready gauge
+sa_endpoint_addresses_ready{cluster="",endpoint="api",namespace="",type="interactive"} 3
+# HELP sa_endpoint_addresses_total Number of addresses, ready or not, of an endpoint, aggr on the window of its type
+# TYPE sa_endpoint_addresses_total gauge
+sa_endpoint_addresses_total{cluster="",endpoint="api",namespace="",type="interactive"} 3
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="api",namespace="",product="Shop",type="interactive"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_endpoint_addresses_ready", "sa_endpoint_addresses_total", "sa_service"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestGetMetricSaInternalScopeReadyQueryFailed(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor")}})
+	fake := &fakePromAPI{
+		results: kubeEndpointAddress(map[string]float64{"Motor": 3}, map[string]float64{}),
+		err:     fmt.Errorf("timeout"),
+		failOn:  `ready="true"`,
+	}
+	exporter := NewExporter(fake, mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+
+	if got := exporter.GetMetricSaInternalScope("batch", "5m", serviceScope{}, mapKeyType["batch"]); got != nil {
+		t.Errorf("GetMetricSaInternalScope() = %+v, want no value when the ready query fails", got)
+	}
+	if len(fake.queries) != 2 {
+		t.Errorf("GetMetricSaInternalScope() queries = %v, want the total and ready queries", fake.queries)
+	}
+}
+
 func TestReadyValue(t *testing.T) {
 	// if 0 => ready == 0, if > 0 => ready == 1
 	want := 0.0
@@ -254,6 +2961,136 @@ func TestExtractValues(t *testing.T) {
 	}
 }
 
+func TestThresholdStateValue(t *testing.T) {
+	threshold := readyThreshold{MinReady: 3}
+	tests := []struct {
+		name  string
+		ready float64
+		want  float64
+	}{
+		{name: "none ready", ready: 0, want: saDown},
+		{name: "below threshold", ready: 1, want: saDegraded},
+		{name: "threshold reached", ready: 3, want: saUp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ThresholdStateValue(tt.ready, 10, threshold); got != tt.want {
+				t.Errorf("ThresholdStateValue(%v) = %v, want %v", tt.ready, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorstState(t *testing.T) {
+	tests := []struct {
+		name        string
+		valuesIn    []float64
+		propagation string
+		want        float64
+	}{
+		{name: "all up", valuesIn: []float64{1, 1}, propagation: propagateDegraded, want: saUp},
+		{name: "down wins", valuesIn: []float64{0.5, 0}, propagation: propagateUp, want: saDown},
+		{name: "degraded propagated as degraded", valuesIn: []float64{1, 0.5}, propagation: propagateDegraded, want: saDegraded},
+		{name: "degraded propagated as down", valuesIn: []float64{1, 0.5}, propagation: propagateDown, want: saDown},
+		{name: "degraded propagated as up", valuesIn: []float64{1, 0.5}, propagation: propagateUp, want: saUp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WorstState(tt.valuesIn, tt.propagation, "test"); got != tt.want {
+				t.Errorf("WorstState(%v, %s) = %v, want %v", tt.valuesIn, tt.propagation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExporterHitPromDegraded(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", readyThreshold: readyThreshold{MinReady: 2}, Endpoints: endpointsOf("Motor", "Tires")},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Motor": 3, "Tires": 3},
+		map[string]float64{"Motor": 2},
+	))
+	exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+	exporter.degradedEnabled = true
+	exporter.degradedPropagation = propagateDegraded
+
+	want := `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 0.5
+sa_service{cluster="",endpoint="Tires",namespace="",product="Car",type="batch"} 1
+# HELP sa_service_overall Overall Service Availability aggr
+# TYPE sa_service_overall gauge
+sa_service_overall{cluster="",namespace="",product="Car"} 0.5
+# HELP sa_service_state Overall Service Availability state of the product, 1 for its current state among up, degraded and down
+# TYPE sa_service_state gauge
+sa_service_state{cluster="",namespace="",product="Car",state="degraded"} 1
+sa_service_state{cluster="",namespace="",product="Car",state="down"} 0
+sa_service_state{cluster="",namespace="",product="Car",state="up"} 0
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 0.5
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(want), "sa_service", "sa_service_type", "sa_service_overall", "sa_service_state"); err != nil {
+		t.Errorf("Collect() unexpected metrics: %v", err)
+	}
+}
+
+func TestExporterHitPromOptional(t *testing.T) {
+	mapKeyType, mapKeyEndpoint := createServicesMaps([]services{
+		{Product: "Car", Type: "batch", Endpoints: []serviceEndpoint{{Name: "Motor"}, {Name: "Radio", Optional: true}}},
+	})
+	promURL := fakePrometheus(t, kubeEndpointAddress(
+		map[string]float64{"Motor": 1, "Radio": 1},
+		map[string]float64{"Radio": 1},
+	))
+
+	tests := []struct {
+		name            string
+		degradedEnabled bool
+		want            string
+	}{
+		{
+			name: "optional down ignored",
+			want: `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="Radio",namespace="",product="Car",type="batch"} 0
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 1
+`,
+		},
+		{
+			name:            "optional down degrades",
+			degradedEnabled: true,
+			want: `
+# HELP sa_service Internal Service Availability per endpoint, aggr on the window of its type (1m for interactive, 5m for batch by default)
+# TYPE sa_service gauge
+sa_service{cluster="",endpoint="Motor",namespace="",product="Car",type="batch"} 1
+sa_service{cluster="",endpoint="Radio",namespace="",product="Car",type="batch"} 0
+# HELP sa_service_type Service Availability per type (interactive, batch or custom types) aggr on the window of the type
+# TYPE sa_service_type gauge
+sa_service_type{cluster="",namespace="",product="Car",type="batch"} 0.5
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := NewExporter(newPromClient(promURL, defaultPromTimeout), mapKeyType, mapKeyEndpoint, map[string]string{"batch": "5m"})
+			exporter.degradedEnabled = tt.degradedEnabled
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(tt.want), "sa_service", "sa_service_type"); err != nil {
+				t.Errorf("Collect() unexpected metrics: %v", err)
+			}
+		})
+	}
+}
+
 func TestZeroAlwaysWin(t *testing.T) {
 	// if at least one 0 => SA == 0
 	want := 0.0
@@ -266,14 +3103,14 @@ func TestZeroAlwaysWin(t *testing.T) {
 	}
 }
 
-func TestCheckIfExternalServiceMap(t *testing.T) {
-	want := "mapped-services/test.json"
-	if got := checkIfExternalServiceMap("mapped-services", "resources/services.json"); got != want {
-		t.Errorf("TestCheckIfExternalServiceMap(0) = got %q, want %q", got, want)
+func TestFindServiceMapFiles(t *testing.T) {
+	want := []string{"mapped-services/test.json"}
+	if got := findServiceMapFiles(serviceMapConfig{externalServicePath: "mapped-services", defaultServiceFile: "resources/services.json", pattern: "*.json"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("TestFindServiceMapFiles(0) = got %q, want %q", got, want)
 	}
-	want = "resources/services.json"
-	if got := checkIfExternalServiceMap("WRONG", "resources/services.json"); got != want {
-		t.Errorf("TestCheckIfExternalServiceMap(1) = got %q, want %q", got, want)
+	want = []string{"resources/services.json"}
+	if got := findServiceMapFiles(serviceMapConfig{externalServicePath: "WRONG", defaultServiceFile: "resources/services.json", pattern: "*.json"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("TestFindServiceMapFiles(1) = got %q, want %q", got, want)
 	}
 }
 
@@ -316,8 +3153,8 @@ func TestOpenServices(t *testing.T) {
 
 func TestCreateServicesMaps(t *testing.T) {
 	testServices := []services{
-		{Product: "TestProduct1", Type: "interactive", Endpoints: []string{"endpoint1", "endpoint2"}},
-		{Product: "TestProduct2", Type: "batch", Endpoints: []string{"endpoint3"}},
+		{Product: "TestProduct1", Type: "interactive", Endpoints: endpointsOf("endpoint1", "endpoint2")},
+		{Product: "TestProduct2", Type: "batch", Endpoints: endpointsOf("endpoint3")},
 	}
 
 	mapKeyType, mapKeyEndpoint := createServicesMaps(testServices)
@@ -327,7 +3164,7 @@ func TestCreateServicesMaps(t *testing.T) {
 		t.Errorf("createServicesMaps() mapKeyType length = %v, want %v", len(mapKeyType), 2)
 	}
 
-	expectedInteractive := []string{"endpoint1", "endpoint2"}
+	expectedInteractive := endpointsOf("endpoint1", "endpoint2")
 	if !reflect.DeepEqual(mapKeyType["interactive"], expectedInteractive) {
 		t.Errorf("createServicesMaps() interactive endpoints = %v, want %v", mapKeyType["interactive"], expectedInteractive)
 	}
@@ -338,32 +3175,32 @@ func TestCreateServicesMaps(t *testing.T) {
 	}
 
 	expectedProduct := []string{"TestProduct1"}
-	if !reflect.DeepEqual(mapKeyEndpoint["endpoint1"], expectedProduct) {
-		t.Errorf("createServicesMaps() endpoint1 products = %v, want %v", mapKeyEndpoint["endpoint1"], expectedProduct)
+	if !reflect.DeepEqual(mapKeyEndpoint[serviceEndpoint{Name: "endpoint1"}], expectedProduct) {
+		t.Errorf("createServicesMaps() endpoint1 products = %v, want %v", mapKeyEndpoint[serviceEndpoint{Name: "endpoint1"}], expectedProduct)
 	}
 }
 
 func TestNewExporter(t *testing.T) {
-	promURL := "http://test:9090"
-	mapKeyType := map[string][]string{"interactive": {"endpoint1"}}
-	mapKeyEndpoint := map[string][]string{"endpoint1": {"Product1"}}
+	prom := newPromClient("http://test:9090", time.Second)
+	mapKeyType := map[string][]serviceEndpoint{"interactive": endpointsOf("endpoint1")}
+	mapKeyEndpoint := map[serviceEndpoint][]string{{Name: "endpoint1"}: {"Product1"}}
 	saInteractiveAggr := "1m"
-	saBatchAggr := "5m"
+	typesAggr := map[string]string{"interactive": saInteractiveAggr, "batch": "5m"}
 
-	exporter := NewExporter(promURL, mapKeyType, mapKeyEndpoint, saInteractiveAggr, saBatchAggr)
+	exporter := NewExporter(prom, mapKeyType, mapKeyEndpoint, typesAggr)
 
-	if exporter.promURL != promURL {
-		t.Errorf("NewExporter() promURL = %v, want %v", exporter.promURL, promURL)
+	if exporter.prom != promAPI(prom) {
+		t.Errorf("NewExporter() prom = %v, want %v", exporter.prom, prom)
 	}
-	if exporter.saInteractiveAggr != saInteractiveAggr {
-		t.Errorf("NewExporter() saInteractiveAggr = %v, want %v", exporter.saInteractiveAggr, saInteractiveAggr)
+	if exporter.typesAggr["interactive"] != saInteractiveAggr {
+		t.Errorf("NewExporter() interactive aggr = %v, want %v", exporter.typesAggr["interactive"], saInteractiveAggr)
 	}
 }
 
 func TestExporterDescribe(t *testing.T) {
-	exporter := NewExporter("", nil, nil, "", "")
+	exporter := NewExporter(newPromClient("", defaultPromTimeout), nil, nil, nil)
 
-	ch := make(chan *prometheus.Desc, 10)
+	ch := make(chan *prometheus.Desc, 32)
 	exporter.Describe(ch)
 	close(ch)
 
@@ -372,7 +3209,7 @@ func TestExporterDescribe(t *testing.T) {
 		descriptions = append(descriptions, desc)
 	}
 
-	expectedCount := 4 // up, metricSaInternal, metricSaType, metricSaOverall
+	expectedCount := 17 // up, metricSaInternal, metricSaMissing, metricAddressesReady, metricAddressesTotal, metricAddressesTerminating, metricProbeSuccess, metricProbeDuration, metricUnmappedEndpoint, metricSaType, metricSaOverall, metricSaEffective, metricSaState, configLastReloadSuccessful, configLastReloadTimestamp, evaluationTimestamp, evaluationDuration
 	if len(descriptions) != expectedCount {
 		t.Errorf("Describe() returned %d descriptions, want %d", len(descriptions), expectedCount)
 	}
@@ -382,38 +3219,38 @@ func TestBuildSaQueryEndpointsEdgeCases(t *testing.T) {
 	tests := []struct {
 		name         string
 		typeEndpoint string
-		mapKeyType   map[string][]string
+		mapKeyType   map[string][]serviceEndpoint
 		want         string
 	}{
 		{
 			name:         "empty map",
 			typeEndpoint: "interactive",
-			mapKeyType:   map[string][]string{},
+			mapKeyType:   map[string][]serviceEndpoint{},
 			want:         "",
 		},
 		{
 			name:         "non-existent type",
 			typeEndpoint: "nonexistent",
-			mapKeyType:   map[string][]string{"interactive": {"endpoint1"}},
+			mapKeyType:   map[string][]serviceEndpoint{"interactive": endpointsOf("endpoint1")},
 			want:         "",
 		},
 		{
 			name:         "single endpoint",
 			typeEndpoint: "interactive",
-			mapKeyType:   map[string][]string{"interactive": {"endpoint1"}},
+			mapKeyType:   map[string][]serviceEndpoint{"interactive": endpointsOf("endpoint1")},
 			want:         "endpoint1|",
 		},
 		{
 			name:         "multiple endpoints",
 			typeEndpoint: "batch",
-			mapKeyType:   map[string][]string{"batch": {"endpoint1", "endpoint2", "endpoint3"}},
+			mapKeyType:   map[string][]serviceEndpoint{"batch": endpointsOf("endpoint1", "endpoint2", "endpoint3")},
 			want:         "endpoint1|endpoint2|endpoint3|",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := BuildSaQueryEndpoints(tt.typeEndpoint, tt.mapKeyType)
+			got := BuildSaQueryEndpoints(tt.mapKeyType[tt.typeEndpoint])
 			if got != tt.want {
 				t.Errorf("BuildSaQueryEndpoints() = %v, want %v", got, tt.want)
 			}
@@ -421,44 +3258,6 @@ func TestBuildSaQueryEndpointsEdgeCases(t *testing.T) {
 	}
 }
 
-func TestFindProductsForEndpointRegex(t *testing.T) {
-	mapKeyEndpoint := map[string][]string{
-		"my-svc-.*": {"MyProduct"},
-		"^kafka$":   {"MyProduct2", "MyProduct3"},
-	}
-
-	tests := []struct {
-		name         string
-		endpoint     string
-		wantProducts []string
-	}{
-		{
-			name:         "exact match kafka",
-			endpoint:     "kafka",
-			wantProducts: []string{"MyProduct2", "MyProduct3"},
-		},
-		{
-			name:         "platform wildcard match",
-			endpoint:     "my-svc-api",
-			wantProducts: []string{"MyProduct"},
-		},
-		{
-			name:         "no match",
-			endpoint:     "unknown-service",
-			wantProducts: nil,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := FindProductsForEndpoint(tt.endpoint, mapKeyEndpoint)
-			if !reflect.DeepEqual(got, tt.wantProducts) {
-				t.Errorf("FindProductsForEndpoint() = %v, want %v", got, tt.wantProducts)
-			}
-		})
-	}
-}
-
 func TestExtractValuesEdgeCases(t *testing.T) {
 	productTypeEndpointValues := []ProductTypeEndpointValue{
 		{Product: "Product1", Type: "interactive", Endpoint: "endpoint1", Value: 1.0},
@@ -637,25 +3436,13 @@ func TestFindProductsFromQueryResultEdgeCases(t *testing.T) {
 
 // Benchmark tests for performance-critical functions
 func BenchmarkBuildSaQueryEndpoints(b *testing.B) {
-	mapKeyType := map[string][]string{
-		"interactive": {"endpoint1", "endpoint2", "endpoint3", "endpoint4", "endpoint5"},
-	}
-
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		BuildSaQueryEndpoints("interactive", mapKeyType)
-	}
-}
-
-func BenchmarkFindProductsForEndpoint(b *testing.B) {
-	mapKeyEndpoint := map[string][]string{
-		"Wheel": {"Car"},
-		"Whe.*": {"Car"},
+	mapKeyType := map[string][]serviceEndpoint{
+		"interactive": endpointsOf("endpoint1", "endpoint2", "endpoint3", "endpoint4", "endpoint5"),
 	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		FindProductsForEndpoint("Wheel", mapKeyEndpoint)
+		BuildSaQueryEndpoints(mapKeyType["interactive"])
 	}
 }
 
@@ -672,11 +3459,10 @@ func BenchmarkZeroAlwaysWin(b *testing.B) {
 func TestExporterCollect(t *testing.T) {
 	// Create a test exporter with minimal config
 	exporter := NewExporter(
-		"http://test-prom:9090",
-		map[string][]string{"interactive": {"test-endpoint"}},
-		map[string][]string{"test-endpoint": {"TestProduct"}},
-		"1m",
-		"5m",
+		newPromClient("http://test-prom:9090", defaultPromTimeout),
+		map[string][]serviceEndpoint{"interactive": endpointsOf("test-endpoint")},
+		map[serviceEndpoint][]string{{Name: "test-endpoint"}: {"TestProduct"}},
+		map[string]string{"interactive": "1m", "batch": "5m"},
 	)
 
 	// Create a channel to collect metrics
@@ -716,11 +3502,10 @@ func TestExporterCollect(t *testing.T) {
 // Tests for uncovered functions in collector_prom.go
 func TestExporterCollectPromMetrics(t *testing.T) {
 	exporter := NewExporter(
-		"http://unreachable:9090", // Unreachable URL to test error path
-		map[string][]string{"interactive": {"test-endpoint"}},
-		map[string][]string{"test-endpoint": {"TestProduct"}},
-		"1m",
-		"5m",
+		newPromClient("http://unreachable:9090", defaultPromTimeout), // Unreachable URL to test error path
+		map[string][]serviceEndpoint{"interactive": endpointsOf("test-endpoint")},
+		map[serviceEndpoint][]string{{Name: "test-endpoint"}: {"TestProduct"}},
+		map[string]string{"interactive": "1m", "batch": "5m"},
 	)
 
 	ch := make(chan prometheus.Metric, 10)
@@ -756,11 +3541,10 @@ func TestExporterTestProm(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			exporter := NewExporter(
-				tt.promURL,
+				newPromClient(tt.promURL, defaultPromTimeout),
+				nil,
 				nil,
 				nil,
-				"",
-				"",
 			)
 
 			err := exporter.TestProm()
@@ -773,17 +3557,16 @@ func TestExporterTestProm(t *testing.T) {
 
 func TestExporterHitProm(t *testing.T) {
 	exporter := NewExporter(
-		"http://unreachable:9090", // This will cause the function to return early due to connection failure
-		map[string][]string{
-			"interactive": {"test-endpoint-interactive"},
-			"batch":       {"test-endpoint-batch"},
+		newPromClient("http://unreachable:9090", defaultPromTimeout), // This will cause the function to return early due to connection failure
+		map[string][]serviceEndpoint{
+			"interactive": endpointsOf("test-endpoint-interactive"),
+			"batch":       endpointsOf("test-endpoint-batch"),
 		},
-		map[string][]string{
-			"test-endpoint-interactive": {"TestProduct"},
-			"test-endpoint-batch":       {"TestProduct"},
+		map[serviceEndpoint][]string{
+			{Name: "test-endpoint-interactive"}: {"TestProduct"},
+			{Name: "test-endpoint-batch"}:       {"TestProduct"},
 		},
-		"1m",
-		"5m",
+		map[string]string{"interactive": "1m", "batch": "5m"},
 	)
 
 	ch := make(chan prometheus.Metric, 100)
@@ -805,15 +3588,14 @@ func TestExporterHitProm(t *testing.T) {
 
 func TestExporterGetMetricSaInternal(t *testing.T) {
 	exporter := NewExporter(
-		"http://unreachable:9090", // This will cause queries to fail
-		map[string][]string{
-			"interactive": {"test-endpoint"},
+		newPromClient("http://unreachable:9090", defaultPromTimeout), // This will cause queries to fail
+		map[string][]serviceEndpoint{
+			"interactive": endpointsOf("test-endpoint"),
 		},
-		map[string][]string{
-			"test-endpoint": {"TestProduct"},
+		map[serviceEndpoint][]string{
+			{Name: "test-endpoint"}: {"TestProduct"},
 		},
-		"1m",
-		"5m",
+		map[string]string{"interactive": "1m", "batch": "5m"},
 	)
 
 	result := exporter.GetMetricSaInternal("interactive", "1m")
@@ -834,25 +3616,25 @@ func TestExporterGetMetricSaInternalEdgeCases(t *testing.T) {
 	tests := []struct {
 		name         string
 		typeEndpoint string
-		mapKeyType   map[string][]string
+		mapKeyType   map[string][]serviceEndpoint
 		wantEmpty    bool
 	}{
 		{
 			name:         "non-existent type",
 			typeEndpoint: "nonexistent",
-			mapKeyType:   map[string][]string{"interactive": {"endpoint1"}},
+			mapKeyType:   map[string][]serviceEndpoint{"interactive": endpointsOf("endpoint1")},
 			wantEmpty:    true,
 		},
 		{
 			name:         "empty endpoints for type",
 			typeEndpoint: "batch",
-			mapKeyType:   map[string][]string{"batch": {}},
+			mapKeyType:   map[string][]serviceEndpoint{"batch": endpointsOf()},
 			wantEmpty:    true,
 		},
 		{
 			name:         "valid type with endpoints",
 			typeEndpoint: "interactive",
-			mapKeyType:   map[string][]string{"interactive": {"endpoint1"}},
+			mapKeyType:   map[string][]serviceEndpoint{"interactive": endpointsOf("endpoint1")},
 			wantEmpty:    false, // But will be empty due to connection failure
 		},
 	}
@@ -860,11 +3642,10 @@ func TestExporterGetMetricSaInternalEdgeCases(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			exporter := NewExporter(
-				"http://unreachable:9090",
+				newPromClient("http://unreachable:9090", defaultPromTimeout),
 				tt.mapKeyType,
-				map[string][]string{"endpoint1": {"TestProduct"}},
-				"1m",
-				"5m",
+				map[serviceEndpoint][]string{{Name: "endpoint1"}: {"TestProduct"}},
+				map[string]string{"interactive": "1m", "batch": "5m"},
 			)
 
 			result := exporter.GetMetricSaInternal(tt.typeEndpoint, "1m")
@@ -958,22 +3739,22 @@ func TestCreateServicesMapsComplexScenario(t *testing.T) {
 		{
 			Product:   "Product1",
 			Type:      "interactive",
-			Endpoints: []string{"endpoint1", "endpoint2", "endpoint3"},
+			Endpoints: endpointsOf("endpoint1", "endpoint2", "endpoint3"),
 		},
 		{
 			Product:   "Product2",
 			Type:      "interactive",
-			Endpoints: []string{"endpoint4"},
+			Endpoints: endpointsOf("endpoint4"),
 		},
 		{
 			Product:   "Product1", // Same product, different type
 			Type:      "batch",
-			Endpoints: []string{"endpoint5", "endpoint6"},
+			Endpoints: endpointsOf("endpoint5", "endpoint6"),
 		},
 		{
 			Product:   "Product3",
 			Type:      "batch",
-			Endpoints: []string{"endpoint7", "endpoint8", "endpoint9", "endpoint10"},
+			Endpoints: endpointsOf("endpoint7", "endpoint8", "endpoint9", "endpoint10"),
 		},
 	}
 
@@ -1003,17 +3784,17 @@ func TestCreateServicesMapsComplexScenario(t *testing.T) {
 	}
 
 	// Check that endpoint1 maps to Product1
-	if len(mapKeyEndpoint["endpoint1"]) != 1 || mapKeyEndpoint["endpoint1"][0] != "Product1" {
-		t.Errorf("createServicesMaps() endpoint1 products = %v, want [Product1]", mapKeyEndpoint["endpoint1"])
+	if len(mapKeyEndpoint[serviceEndpoint{Name: "endpoint1"}]) != 1 || mapKeyEndpoint[serviceEndpoint{Name: "endpoint1"}][0] != "Product1" {
+		t.Errorf("createServicesMaps() endpoint1 products = %v, want [Product1]", mapKeyEndpoint[serviceEndpoint{Name: "endpoint1"}])
 	}
 
 	// Check that endpoint5 (Product1 batch) maps to Product1
-	if len(mapKeyEndpoint["endpoint5"]) != 1 || mapKeyEndpoint["endpoint5"][0] != "Product1" {
-		t.Errorf("createServicesMaps() endpoint5 products = %v, want [Product1]", mapKeyEndpoint["endpoint5"])
+	if len(mapKeyEndpoint[serviceEndpoint{Name: "endpoint5"}]) != 1 || mapKeyEndpoint[serviceEndpoint{Name: "endpoint5"}][0] != "Product1" {
+		t.Errorf("createServicesMaps() endpoint5 products = %v, want [Product1]", mapKeyEndpoint[serviceEndpoint{Name: "endpoint5"}])
 	}
 }
 
-func TestCheckIfExternalServiceMapWithMultipleFiles(t *testing.T) {
+func TestFindServiceMapFilesWithMultipleFiles(t *testing.T) {
 	// Create a temporary directory with multiple JSON files
 	tmpDir, err := os.MkdirTemp("", "testservices")
 	if err != nil {
@@ -1021,8 +3802,13 @@ func TestCheckIfExternalServiceMapWithMultipleFiles(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// Create multiple JSON files
-	files := []string{"service1.json", "service2.json", "notjson.txt"}
+	// Create multiple JSON files, in a sub directory and in a hidden ConfigMap directory too
+	for _, dir := range []string{"team-a", "..2024_01_01_00_00_00.000000000"} {
+		if err := os.Mkdir(filepath.Join(tmpDir, dir), 0o755); err != nil {
+			t.Fatalf("Failed to create temp dir %s: %v", dir, err)
+		}
+	}
+	files := []string{"service2.json", "service1.json", "notjson.txt", "service4.yaml", "team-a/service3.json", "..2024_01_01_00_00_00.000000000/service1.json"}
 	for _, filename := range files {
 		tmpFile, err := os.Create(filepath.Join(tmpDir, filename))
 		if err != nil {
@@ -1031,23 +3817,113 @@ func TestCheckIfExternalServiceMapWithMultipleFiles(t *testing.T) {
 		tmpFile.Close()
 	}
 
-	result := checkIfExternalServiceMap(tmpDir, "default.json")
+	tests := []struct {
+		name   string
+		config serviceMapConfig
+		want   []string
+	}{
+		{
+			name:   "all JSON files",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "*.json"},
+			want:   []string{filepath.Join(tmpDir, "service1.json"), filepath.Join(tmpDir, "service2.json")},
+		},
+		{
+			name:   "recursive",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "*.json", recursive: true},
+			want:   []string{filepath.Join(tmpDir, "service1.json"), filepath.Join(tmpDir, "service2.json"), filepath.Join(tmpDir, "team-a", "service3.json")},
+		},
+		{
+			name:   "glob",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "service[2-3].json", recursive: true},
+			want:   []string{filepath.Join(tmpDir, "service2.json"), filepath.Join(tmpDir, "team-a", "service3.json")},
+		},
+		{
+			name:   "default layered underneath",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "*.json", includeDefault: true},
+			want:   []string{"default.json", filepath.Join(tmpDir, "service1.json"), filepath.Join(tmpDir, "service2.json")},
+		},
+		{
+			name:   "supported formats only",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "*"},
+			want:   []string{filepath.Join(tmpDir, "service1.json"), filepath.Join(tmpDir, "service2.json"), filepath.Join(tmpDir, "service4.yaml")},
+		},
+		{
+			name:   "no match falls back on default",
+			config: serviceMapConfig{externalServicePath: tmpDir, defaultServiceFile: "default.json", pattern: "*.toml"},
+			want:   []string{"default.json"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findServiceMapFiles(tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findServiceMapFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
 
-	// Should return the first JSON file found
-	expectedFiles := []string{
-		filepath.Join(tmpDir, "service1.json"),
-		filepath.Join(tmpDir, "service2.json"),
+func TestMergeServices(t *testing.T) {
+	files := []serviceMapFile{
+		{filename: "team-a.json", services: []services{
+			{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor", "Tires")},
+		}},
+		{filename: "team-b.json", services: []services{
+			{Product: "Car", Type: "batch", Endpoints: endpointsOf("Tires", "Brakes")},
+			{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Tires")},
+			{Product: "Plane", Type: "batch", Endpoints: endpointsOf("Motor")},
+		}},
 	}
 
-	found := false
-	for _, expected := range expectedFiles {
-		if result == expected {
-			found = true
-			break
+	got, conflicts := mergeServices(files)
+	want := []services{
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Motor", "Tires")},
+		{Product: "Car", Type: "batch", Endpoints: endpointsOf("Brakes")},
+		{Product: "Car", Type: "interactive", Endpoints: endpointsOf("Tires")},
+		{Product: "Plane", Type: "batch", Endpoints: endpointsOf("Motor")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeServices() = %v, want %v", got, want)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("mergeServices() conflicts = %v, want 1 conflict", conflicts)
+	}
+	wantConflict := `team-b.json: product "Car" type "batch" endpoint "Tires" is already defined in team-a.json`
+	if conflicts[0].Error() != wantConflict {
+		t.Errorf("mergeServices() conflict = %q, want %q", conflicts[0], wantConflict)
+	}
+}
+
+func TestLoadServiceMapIncludeDefault(t *testing.T) {
+	dir := writeServiceMap(t, `[{"product":"Metrics","type":"batch","endpoints":["victoria-metrics"]}]`)
+	config := testServiceMapConfig(dir)
+	config.defaultServiceFile = "../resources/services.json"
+	config.includeDefault = true
+
+	got, err := loadServiceMap(config)
+	if err != nil {
+		t.Fatalf("loadServiceMap() error = %v", err)
+	}
+
+	products := make(map[string][]string)
+	for _, service := range got {
+		for _, endpoint := range service.Endpoints {
+			products[service.Product] = append(products[service.Product], endpoint.Name)
 		}
 	}
+	// Metrics is overridden by the mapped file, Logs and Traces come from the default map
+	if !reflect.DeepEqual(products["Metrics"], []string{"victoria-metrics"}) {
+		t.Errorf("loadServiceMap() Metrics endpoints = %v, want [victoria-metrics]", products["Metrics"])
+	}
+	if len(products["Logs"]) == 0 || len(products["Traces"]) == 0 {
+		t.Errorf("loadServiceMap() products = %v, want Logs and Traces from the default map", products)
+	}
+}
 
-	if !found {
-		t.Errorf("checkIfExternalServiceMap() = %v, expected one of %v", result, expectedFiles)
+func TestLoadServiceMapError(t *testing.T) {
+	dir := writeServiceMap(t, `{invalid json`)
+	if _, err := loadServiceMap(testServiceMapConfig(dir)); err == nil {
+		t.Error("loadServiceMap() expected error for invalid JSON but got nil")
 	}
 }
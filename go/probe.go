@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// defaultProbeTimeout is the timeout of a probe without its own
+const defaultProbeTimeout = 5 * time.Second
+
+// Rules combining the result of a probe with the Kubernetes readiness of its endpoint.
+const (
+	combineAnd   = "and"
+	combineOr    = "or"
+	combineProbe = "probe"
+	combineNone  = "none"
+)
+
+// probeCombines are the combination rules accepted in the service map, and by default.
+var probeCombines = []string{combineAnd, combineOr, combineProbe, combineNone}
+
+// probeConfig is the active probe of an endpoint, executed by the exporter at every collection.
+// Only one module (http, tcp or grpc) must be set.
+type probeConfig struct {
+	HTTP *httpProbeConfig `json:"http,omitempty"`
+	TCP  *tcpProbeConfig  `json:"tcp,omitempty"`
+	GRPC *grpcProbeConfig `json:"grpc,omitempty"`
+	// Combine tells how the probe result is combined with the Kubernetes readiness
+	Combine string `json:"combine,omitempty"`
+	// Timeout is a Prometheus duration, 5s by default
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// httpProbeConfig is an HTTP probe, successful if the response has one of the expected status
+// codes (2xx by default) and its body matches the regex if any.
+type httpProbeConfig struct {
+	URL         string         `json:"url"`
+	StatusCodes []int          `json:"status_codes,omitempty"`
+	BodyRegex   string         `json:"body_regex,omitempty"`
+	TLS         tlsProbeConfig `json:"tls"`
+}
+
+// tcpProbeConfig is a TCP probe, successful if a connection can be opened to the host:port address.
+type tcpProbeConfig struct {
+	Address string `json:"address"`
+}
+
+// grpcProbeConfig is a gRPC probe, successful if grpc.health.v1.Health/Check answers SERVING for the service,
+// the whole server if the service is empty. The connection uses TLS only if tls is set.
+type grpcProbeConfig struct {
+	Address string          `json:"address"`
+	Service string          `json:"service,omitempty"`
+	TLS     *tlsProbeConfig `json:"tls,omitempty"`
+}
+
+// tlsProbeConfig are the TLS settings of a probe.
+type tlsProbeConfig struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// probeResult is the result of the probe of an endpoint.
+type probeResult struct {
+	Success  bool
+	Duration time.Duration
+}
+
+// prober runs one kind of probe, returning an error if the probe failed.
+type prober interface {
+	Probe(ctx context.Context) error
+}
+
+// newProber returns the prober of the module set in the probe configuration.
+func newProber(config *probeConfig) (prober, error) {
+	switch {
+	case config.HTTP != nil:
+		return newHTTPProber(config.HTTP)
+	case config.TCP != nil:
+		return &tcpProber{config: config.TCP}, nil
+	case config.GRPC != nil:
+		return newGRPCProber(config.GRPC)
+	}
+	return nil, fmt.Errorf("no probe module set")
+}
+
+// probeTimeout returns the timeout of the probe, the default one if not set.
+func probeTimeout(config *probeConfig) time.Duration {
+	if config.Timeout == "" {
+		return defaultProbeTimeout
+	}
+	timeout, err := model.ParseDuration(config.Timeout)
+	if err != nil {
+		return defaultProbeTimeout
+	}
+	return time.Duration(timeout)
+}
+
+// runProbe executes the probe of an endpoint within its timeout.
+func runProbe(endpoint serviceEndpoint) probeResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout(endpoint.Probe))
+	defer cancel()
+
+	p, err := newProber(endpoint.Probe)
+	if err == nil {
+		err = p.Probe(ctx)
+	}
+	duration := time.Since(start)
+	if err != nil {
+		log.Info("Probe failed for endpoint : ", endpoint.Name, " , ", err)
+		return probeResult{Success: false, Duration: duration}
+	}
+	return probeResult{Success: true, Duration: duration}
+}
+
+// RunProbes executes in parallel the probes of the endpoints having one.
+func RunProbes(endpoints []serviceEndpoint) map[serviceEndpoint]probeResult {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[serviceEndpoint]probeResult)
+	for _, endpoint := range endpoints {
+		if endpoint.Probe == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(endpoint serviceEndpoint) {
+			defer wg.Done()
+			probe := runProbe(endpoint)
+			mutex.Lock()
+			result[endpoint] = probe
+			mutex.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+	return result
+}
+
+// CollectProbes sends sa_probe_success and sa_probe_duration_seconds for every product of the probed endpoints.
+func CollectProbes(ch chan<- prometheus.Metric, typeEndpoint string, probes map[serviceEndpoint]probeResult, mapKeyEndpoint map[serviceEndpoint][]string) {
+	for endpoint, probe := range probes {
+		success := 0.0
+		if probe.Success {
+			success = 1.0
+		}
+		for _, product := range mapKeyEndpoint[endpoint] {
+			ch <- prometheus.MustNewConstMetric(
+				metricProbeSuccess, prometheus.GaugeValue, success, product, typeEndpoint, endpoint.Name, endpoint.Namespace, endpoint.Cluster,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				metricProbeDuration, prometheus.GaugeValue, probe.Duration.Seconds(), product, typeEndpoint, endpoint.Name, endpoint.Namespace, endpoint.Cluster,
+			)
+		}
+	}
+}
+
+// CombineProbes combines the probe results with the readiness values of the endpoints of a type,
+// following the combination rule of every probe. An endpoint without readiness series is no longer missing
+// when its probe decides alone of its value.
+func CombineProbes(values []ProductTypeEndpointValue, endpoints []serviceEndpoint, probes map[serviceEndpoint]probeResult, mapKeyEndpoint map[serviceEndpoint][]string) {
+	if len(probes) == 0 {
+		return
+	}
+	endpointsByScope := GroupEndpointsByScope(endpoints)
+	for i, elem := range values {
+		scope := serviceScope{Namespace: elem.Namespace, Cluster: elem.Cluster}
+		endpoint := FindConfiguredEndpoint(elem.Endpoint, elem.Product, endpointsByScope[scope], mapKeyEndpoint)
+		probe, ok := probes[endpoint]
+		if !ok {
+			continue
+		}
+		probeValue := 0.0
+		if probe.Success {
+			probeValue = 1.0
+		}
+		values[i].Value = CombineProbe(elem.Value, probeValue, endpoint.Probe.Combine)
+		if elem.Missing && (endpoint.Probe.Combine == combineProbe || (endpoint.Probe.Combine == combineOr && probe.Success)) {
+			values[i].Missing = false
+		}
+	}
+}
+
+// CombineProbe combines the readiness value of an endpoint with the result of its probe.
+func CombineProbe(readyValue float64, probeValue float64, combine string) float64 {
+	switch combine {
+	case combineOr:
+		return math.Max(readyValue, probeValue)
+	case combineProbe:
+		return probeValue
+	case combineNone:
+		return readyValue
+	}
+	return math.Min(readyValue, probeValue)
+}
+
+// httpProber probes an URL over HTTP or HTTPS.
+type httpProber struct {
+	config    *httpProbeConfig
+	client    *http.Client
+	bodyRegex *regexp.Regexp
+}
+
+func newHTTPProber(config *httpProbeConfig) (*httpProber, error) {
+	tlsConfig, err := newProbeTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	p := &httpProber{
+		config: config,
+		//the prober lives for one probe only, its connection must not be kept
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}},
+	}
+	if config.BodyRegex != "" {
+		if p.bodyRegex, err = regexp.Compile(config.BodyRegex); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *httpProber) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !expectedStatusCode(resp.StatusCode, p.config.StatusCodes) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if p.bodyRegex != nil {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !p.bodyRegex.Match(body) {
+			return fmt.Errorf("body does not match %q", p.config.BodyRegex)
+		}
+	}
+	return nil
+}
+
+// expectedStatusCode tells if the status code is one of the expected ones, any 2xx if none is.
+func expectedStatusCode(statusCode int, expected []int) bool {
+	if len(expected) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	for _, code := range expected {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpProber opens a TCP connection.
+type tcpProber struct {
+	config *tcpProbeConfig
+}
+
+func (p *tcpProber) Probe(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.config.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcProber calls the standard gRPC health service.
+type grpcProber struct {
+	config      *grpcProbeConfig
+	credentials credentials.TransportCredentials
+}
+
+func newGRPCProber(config *grpcProbeConfig) (*grpcProber, error) {
+	p := &grpcProber{config: config, credentials: insecure.NewCredentials()}
+	if config.TLS != nil {
+		tlsConfig, err := newProbeTLSConfig(*config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		p.credentials = credentials.NewTLS(tlsConfig)
+	}
+	return p, nil
+}
+
+func (p *grpcProber) Probe(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, p.config.Address, grpc.WithTransportCredentials(p.credentials), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: p.config.Service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service %q is %s", p.config.Service, resp.Status)
+	}
+	return nil
+}
+
+// newProbeTLSConfig builds the TLS configuration of a probe, loading its CA and client certificate.
+func newProbeTLSConfig(config tlsProbeConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadMutex serializes the reloads triggered by the watcher, SIGHUP and the HTTP endpoint
+var reloadMutex sync.Mutex
+
+// reloadServices reads again the service map and swaps it in the exporter.
+// The current service map is kept if the new one can not be loaded.
+func reloadServices(exporter *Exporter, config serviceMapConfig) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	jsonServices, err := loadServiceMap(config)
+	if err == nil && len(jsonServices) == 0 {
+		err = fmt.Errorf("the service map in %s is empty", config.externalServicePath)
+	}
+	if err != nil {
+		exporter.setReloadStatus(false)
+		log.Error("Reload of the service map failed, keeping the current one: ", err)
+		return err
+	}
+
+	exporter.SetStaticServices(jsonServices)
+	log.Info("Service map reloaded")
+	return nil
+}
+
+// servicesFingerprint returns a hash of the service map files currently selected,
+// it changes whenever a file is added, removed or its content is modified.
+func servicesFingerprint(config serviceMapConfig) (string, error) {
+	hash := sha256.New()
+	for _, filename := range findServiceMapFiles(config) {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		hash.Write([]byte(filename))
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// watchServices polls the service map and reloads it when it changes.
+// Polling works with the symlinks swapped by Kubernetes when a mounted ConfigMap is updated.
+func watchServices(exporter *Exporter, config serviceMapConfig, interval time.Duration) {
+	if interval <= 0 {
+		log.Info("Service map watch disabled")
+		return
+	}
+	fingerprint, err := servicesFingerprint(config)
+	if err != nil {
+		log.Error("Service map watch not able to read the service map: ", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		newFingerprint, err := servicesFingerprint(config)
+		if err != nil {
+			log.Error("Service map watch not able to read the service map: ", err)
+			continue
+		}
+		if newFingerprint == fingerprint {
+			continue
+		}
+		log.Info("Service map change detected")
+		fingerprint = newFingerprint
+		reloadServices(exporter, config)
+	}
+}
+
+// reloadServicesOnSignal reloads the service map on SIGHUP.
+func reloadServicesOnSignal(exporter *Exporter, config serviceMapConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Info("SIGHUP received, reloading the service map")
+		reloadServices(exporter, config)
+	}
+}
+
+// reloadHandler reloads the service map on POST requests.
+func reloadHandler(exporter *Exporter, config serviceMapConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadServices(exporter, config); err != nil {
+			http.Error(w, "Failed to reload the service map: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Service map reloaded\n"))
+	}
+}
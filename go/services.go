@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+type services struct {
+	Product string `json:"product"`
+	Type    string `json:"type"`
+	serviceScope
+	readyThreshold
+	// Source is where the availability of the endpoints comes from, kubernetes by default
+	Source string `json:"source,omitempty"`
+	// Expression is the PromQL expression of the promql source
+	Expression string `json:"expression,omitempty"`
+	// Aggregation combines the endpoints into sa_service_type, OverallAggregation the types of the product into sa_service_overall
+	Aggregation        aggregationConfig `json:"aggregation"`
+	OverallAggregation aggregationConfig `json:"overall_aggregation"`
+	// Weight is the weight of the type in the overall SA of the product
+	Weight float64 `json:"weight,omitempty"`
+	// DependsOn are the products the product needs to be available
+	DependsOn []productDependency `json:"depends_on,omitempty"`
+	Endpoints []serviceEndpoint   `json:"endpoints"`
+}
+
+// productDependency is a product another product depends on, defined either by its name or by an object
+// with its name and whether the dependency is soft. A soft dependency can not make the product down.
+type productDependency struct {
+	Product string `json:"product"`
+	Soft    bool   `json:"soft,omitempty"`
+}
+
+// UnmarshalJSON accepts both "Auth" and {"product":"Auth","soft":true} dependencies.
+func (pd *productDependency) UnmarshalJSON(data []byte) error {
+	var product string
+	if err := json.Unmarshal(data, &product); err == nil {
+		*pd = productDependency{Product: product}
+		return nil
+	}
+	//alias type to not call UnmarshalJSON recursively
+	type plainProductDependency productDependency
+	return decodeJSONStrict(data, (*plainProductDependency)(pd))
+}
+
+// serviceScope restricts endpoints to the namespace and cluster labels matching these regex (any if empty).
+type serviceScope struct {
+	Namespace string `json:"namespace,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+}
+
+// readyThreshold is the minimum number and fraction of ready addresses for an endpoint to be available,
+// a single ready address being enough if both are unset.
+type readyThreshold struct {
+	MinReady      int     `json:"min_ready,omitempty"`
+	MinReadyRatio float64 `json:"min_ready_ratio,omitempty"`
+}
+
+// serviceEndpoint is an endpoint of a service mapping, defined either by its name
+// or by an object with its name and its own scope, ready threshold and weight in the type.
+// An optional endpoint can not make its type down, at worst degraded.
+type serviceEndpoint struct {
+	Name string `json:"name"`
+	serviceScope
+	readyThreshold
+	Weight   float64 `json:"weight,omitempty"`
+	Optional bool    `json:"optional,omitempty"`
+	// Probe is the active probe of the endpoint if any, a pointer to keep serviceEndpoint usable as a map key
+	Probe      *probeConfig `json:"probe,omitempty"`
+	Source     string       `json:"source,omitempty"`
+	Expression string       `json:"expression,omitempty"`
+}
+
+// UnmarshalJSON accepts both "my-svc" and {"name":"my-svc","namespace":"my-ns"} endpoints.
+func (se *serviceEndpoint) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*se = serviceEndpoint{Name: name}
+		return nil
+	}
+	//alias type to not call UnmarshalJSON recursively
+	type plainServiceEndpoint serviceEndpoint
+	return decodeJSONStrict(data, (*plainServiceEndpoint)(se))
+}
+
+// serviceMapConfig tells where the service map files are looked for.
+type serviceMapConfig struct {
+	externalServicePath string
+	defaultServiceFile  string
+	// pattern is the glob the file names must match
+	pattern string
+	// recursive looks for files in the sub directories too
+	recursive bool
+	// includeDefault layers the default service map underneath the external files
+	includeDefault bool
+}
+
+// serviceMapFile is the content of one service map file.
+type serviceMapFile struct {
+	filename string
+	services []services
+}
+
+func findServiceMapFiles(config serviceMapConfig) []string {
+	//will look at the external Service Path
+	//if files are there then sa-exporter will merge them instead of using the default Service one
+	var files []string
+	err := filepath.WalkDir(config.externalServicePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == config.externalServicePath {
+			return nil
+		}
+		//skip the hidden ..data and ..<timestamp> entries of the mounted ConfigMaps, they would be loaded twice
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if !config.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		match, err := filepath.Match(config.pattern, entry.Name())
+		if err != nil {
+			return err
+		}
+		if _, supported := serviceMapFormats[strings.ToLower(filepath.Ext(entry.Name()))]; match && supported {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("findServiceMapFiles not able to read dir for path ", config.externalServicePath, " err ", err)
+	}
+
+	if len(files) == 0 {
+		return []string{config.defaultServiceFile}
+	}
+	if config.includeDefault {
+		return append([]string{config.defaultServiceFile}, files...)
+	}
+	return files
+}
+
+// loadServiceMap loads and merges all the service map files.
+// Conflicting definitions are reported and only the first one is kept.
+func loadServiceMap(config serviceMapConfig) ([]services, error) {
+	var files []serviceMapFile
+	for _, filename := range findServiceMapFiles(config) {
+		log.Info("The file ", filename, " was found and will be merged in the service map.")
+		jsonServices := openServices(filename)
+		if jsonServices == nil {
+			return nil, fmt.Errorf("not able to load the service map %s", filename)
+		}
+		files = append(files, serviceMapFile{filename, jsonServices})
+	}
+
+	if config.includeDefault && len(files) > 1 {
+		layered := layerServices(files[0].services, files[1:])
+		files = append([]serviceMapFile{{files[0].filename, layered}}, files[1:]...)
+	}
+
+	result, conflicts := mergeServices(files)
+	for _, conflict := range conflicts {
+		log.Error("Service map conflict, ", conflict)
+	}
+	//the dependencies can only be checked once all the files are merged
+	if errs := validateDependencies(result); len(errs) > 0 {
+		return nil, &serviceMapError{filename: "the service map", errs: errs}
+	}
+	return result, nil
+}
+
+// layerServices returns the default services whose products are not defined in the overriding files.
+func layerServices(defaults []services, overrides []serviceMapFile) []services {
+	overridden := make(map[string]bool)
+	for _, file := range overrides {
+		for _, service := range file.services {
+			overridden[service.Product] = true
+		}
+	}
+	result := []services{}
+	for _, service := range defaults {
+		if overridden[service.Product] {
+			log.Debug("Product ", service.Product, " of the default service map is overridden")
+			continue
+		}
+		result = append(result, service)
+	}
+	return result
+}
+
+// mergeServices merges the services of several files.
+// An endpoint defined twice for the same product and type is a conflict, only its first definition is kept.
+func mergeServices(files []serviceMapFile) ([]services, []error) {
+	var conflicts []error
+	definedIn := make(map[string]string)
+	result := []services{}
+	for _, file := range files {
+		for _, service := range file.services {
+			merged := service
+			merged.Endpoints = nil
+			for _, endpoint := range service.Endpoints {
+				key := service.Product + "/" + service.Type + "/" + endpoint.Name + "/" + endpoint.Namespace + "/" + endpoint.Cluster
+				if firstFile, ok := definedIn[key]; ok {
+					conflicts = append(conflicts, fmt.Errorf("%s: product %q type %q endpoint %q is already defined in %s",
+						file.filename, service.Product, service.Type, endpoint.Name, firstFile))
+					continue
+				}
+				definedIn[key] = file.filename
+				merged.Endpoints = append(merged.Endpoints, endpoint)
+			}
+			if len(merged.Endpoints) > 0 {
+				result = append(result, merged)
+			}
+		}
+	}
+	return result, conflicts
+}
+
+func openServices(filename string) []services {
+	jsonServices, err := loadServices(filename)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if len(jsonServices) == 0 {
+		log.Error(filename, " is empty or not well formated")
+	}
+	for i := 0; i < len(jsonServices); i++ {
+		log.Trace("Product: " + jsonServices[i].Product)
+		log.Trace("Type: " + jsonServices[i].Type)
+		log.Trace("Endpoints: ", jsonServices[i].Endpoints)
+	}
+	return jsonServices
+}
+
+// loadServices reads, decodes and validates a service map file.
+func loadServices(filename string) ([]services, error) {
+	jsonServices, err := decodeServices(filename)
+	if err != nil {
+		return nil, err
+	}
+	if errs := validateServices(jsonServices, knownTypes); len(errs) > 0 {
+		return nil, &serviceMapError{filename, errs}
+	}
+	return jsonServices, nil
+}
+
+// decodeServices reads and decodes a service map file, unknown fields are rejected.
+// YAML and TOML documents are converted to JSON first, the format being detected from the file extension,
+// so that all the formats share the same model and the same validation.
+func decodeServices(filename string) ([]services, error) {
+	toJSON, ok := serviceMapFormats[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, fmt.Errorf("%s has an unsupported extension, expected .json, .yaml, .yml or .toml", filename)
+	}
+	jsonFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Successfully Opened " + filename)
+
+	defer jsonFile.Close()
+	byteValue, err := io.ReadAll(jsonFile)
+	if err != nil {
+		return nil, err
+	}
+	byteValue, err = toJSON(byteValue)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not well formated: %w", filename, err)
+	}
+	jsonServices := []services{}
+	if err := decodeJSONStrict(byteValue, &jsonServices); err != nil {
+		return nil, fmt.Errorf("%s is not well formated: %w", filename, err)
+	}
+	if jsonServices == nil {
+		jsonServices = []services{}
+	}
+	return jsonServices, nil
+}
+
+// serviceMapFormats converts the supported service map formats to JSON, by file extension
+var serviceMapFormats = map[string]func([]byte) ([]byte, error){
+	".json": func(data []byte) ([]byte, error) { return data, nil },
+	".yaml": yamlToJSON,
+	".yml":  yamlToJSON,
+	".toml": tomlToJSON,
+}
+
+// yamlToJSON converts a YAML service map, a list of services, to JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// tomlToJSON converts a TOML service map to JSON. TOML documents being tables,
+// the services are defined as an array of tables: [[services]].
+func tomlToJSON(data []byte) ([]byte, error) {
+	var document map[string]interface{}
+	if err := toml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	for key := range document {
+		if key != "services" {
+			return nil, fmt.Errorf("unknown key %q, services must be defined with [[services]]", key)
+		}
+	}
+	return json.Marshal(document["services"])
+}
+
+// decodeJSONStrict decodes data in v, failing on unknown fields.
+func decodeJSONStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func createServicesMaps(jsonServices []services) (map[string][]serviceEndpoint, map[serviceEndpoint][]string) {
+	mapKeyEndpoint := make(map[serviceEndpoint][]string)
+	mapKeyType := make(map[string][]serviceEndpoint)
+
+	for i := 0; i < len(jsonServices); i++ {
+		var typeEndpoint = jsonServices[i].Type
+
+		for j := 0; j < len(jsonServices[i].Endpoints); j++ {
+			var endpoint = jsonServices[i].Endpoints[j]
+			//the endpoint inherits the scope of its service when it does not define its own
+			if endpoint.Namespace == "" {
+				endpoint.Namespace = jsonServices[i].Namespace
+			}
+			if endpoint.Cluster == "" {
+				endpoint.Cluster = jsonServices[i].Cluster
+			}
+			//and the source and the ready threshold of its service, the default of the product type
+			if endpoint.Source == "" {
+				endpoint.Source = jsonServices[i].Source
+			}
+			if endpoint.Expression == "" {
+				endpoint.Expression = jsonServices[i].Expression
+			}
+			//an expression is enough to select the promql source
+			if endpoint.Source == "" && endpoint.Expression != "" {
+				endpoint.Source = sourcePromQL
+			}
+			if endpoint.MinReady == 0 {
+				endpoint.MinReady = jsonServices[i].MinReady
+			}
+			if endpoint.MinReadyRatio == 0 {
+				endpoint.MinReadyRatio = jsonServices[i].MinReadyRatio
+			}
+			//an endpoint shared by several products or types is only kept once
+			if !containsEndpoint(mapKeyType[typeEndpoint], endpoint) {
+				mapKeyType[typeEndpoint] = append(mapKeyType[typeEndpoint], endpoint)
+			}
+			if !containsString(mapKeyEndpoint[endpoint], jsonServices[i].Product) {
+				mapKeyEndpoint[endpoint] = append(mapKeyEndpoint[endpoint], jsonServices[i].Product)
+			}
+		}
+	}
+
+	log.Info("Size maps, mapKeyType :", len(mapKeyType), " mapKeyEndpoint : ", len(mapKeyEndpoint))
+	return mapKeyType, mapKeyEndpoint
+}
+
+// anchoredPatterns are the compiled endpoint and namespace regex of the service map in use.
+var anchoredPatterns struct {
+	sync.RWMutex
+	regex map[string]*regexp.Regexp
+}
+
+// compileAnchoredPatterns compiles the endpoint and namespace regex of a service map, once per map swap.
+func compileAnchoredPatterns(mapKeyType map[string][]serviceEndpoint) {
+	regex := make(map[string]*regexp.Regexp)
+	for _, endpoints := range mapKeyType {
+		for _, endpoint := range endpoints {
+			for _, pattern := range []string{endpoint.Name, endpoint.Namespace} {
+				if _, ok := regex[pattern]; !ok {
+					regex[pattern] = regexp.MustCompile("^(?:" + pattern + ")$")
+				}
+			}
+		}
+	}
+	anchoredPatterns.Lock()
+	defer anchoredPatterns.Unlock()
+	anchoredPatterns.regex = regex
+}
+
+// anchoredRegex returns the regex of pattern anchored like the PromQL =~ matcher, the one compiled with the service map
+// in use if any.
+func anchoredRegex(pattern string) *regexp.Regexp {
+	anchoredPatterns.RLock()
+	compiled, ok := anchoredPatterns.regex[pattern]
+	anchoredPatterns.RUnlock()
+	if ok {
+		return compiled
+	}
+	return regexp.MustCompile("^(?:" + pattern + ")$")
+}
+
+// productConfig is the configuration of a product gathered from its mapping entries.
+type productConfig struct {
+	aggregation aggregationConfig
+	types       map[string]typeConfig
+	dependsOn   []productDependency
+}
+
+// typeConfig is the configuration of a type of a product.
+type typeConfig struct {
+	aggregation aggregationConfig
+	weight      float64
+}
+
+// createProductsConfig gathers the aggregation strategies and weights of every product,
+// the first entry setting the overall aggregation of a product winning.
+func createProductsConfig(jsonServices []services) map[string]productConfig {
+	result := make(map[string]productConfig)
+	for _, service := range jsonServices {
+		config, ok := result[service.Product]
+		if !ok {
+			config = productConfig{types: make(map[string]typeConfig)}
+		}
+		if config.aggregation.Strategy == "" {
+			config.aggregation = service.OverallAggregation
+		} else if service.OverallAggregation.Strategy != "" && service.OverallAggregation != config.aggregation {
+			log.Error("Service map conflict, product ", service.Product, " has several overall aggregations, keeping ", config.aggregation.Strategy)
+		}
+		if _, ok := config.types[service.Type]; !ok {
+			config.types[service.Type] = typeConfig{aggregation: service.Aggregation, weight: service.Weight}
+		}
+		for _, dependency := range service.DependsOn {
+			if !containsDependency(config.dependsOn, dependency.Product) {
+				config.dependsOn = append(config.dependsOn, dependency)
+			}
+		}
+		result[service.Product] = config
+	}
+	return result
+}
+
+func containsDependency(dependencies []productDependency, product string) bool {
+	for _, d := range dependencies {
+		if d.Product == product {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEndpoint(endpoints []serviceEndpoint, endpoint serviceEndpoint) bool {
+	for _, e := range endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
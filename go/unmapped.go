@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// UnmappedEndpoint is a Kubernetes endpoint not mapped to any product.
+type UnmappedEndpoint struct {
+	Namespace string `json:"namespace"`
+	Endpoint  string `json:"endpoint"`
+}
+
+// GetUnmappedEndpoints queries all the kube_endpoint_address endpoints, restricted to the namespaces
+// matching unmappedNamespace if set, and returns the ones not matching any endpoint of the service map.
+func (e *Exporter) GetUnmappedEndpoints() ([]UnmappedEndpoint, error) {
+	mapKeyType, _ := e.ServicesMaps()
+
+	selector := ""
+	if e.unmappedNamespace != "" {
+		selector = "namespace=~\"" + e.unmappedNamespace + "\""
+	}
+	queryEndpoints := "count by (namespace, endpoint)(kube_endpoint_address{" + selector + "})"
+	dataEndpoints, err := e.prom.Query(queryEndpoints)
+	if err != nil {
+		log.Error("PromQL query wrong for ", queryEndpoints)
+		return nil, err
+	}
+
+	result := []UnmappedEndpoint{}
+	for _, elem := range dataEndpoints.(model.Vector) {
+		endpoint := UnmappedEndpoint{string(elem.Metric["namespace"]), string(elem.Metric["endpoint"])}
+		if !IsMappedEndpoint(endpoint, mapKeyType) {
+			result = append(result, endpoint)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Endpoint < result[j].Endpoint
+	})
+	log.Info("Found ", len(result), " unmapped endpoints")
+	return result, nil
+}
+
+// IsMappedEndpoint tells if an endpoint matches the name and namespace of any endpoint of the service map,
+// the cluster selector is not checked.
+func IsMappedEndpoint(endpoint UnmappedEndpoint, mapKeyType map[string][]serviceEndpoint) bool {
+	for _, endpoints := range mapKeyType {
+		for _, mapped := range endpoints {
+			//only the Kubernetes endpoints can match
+			if !IsServiceSource(mapped.Source) {
+				continue
+			}
+			if !anchoredRegex(mapped.Name).MatchString(endpoint.Endpoint) {
+				continue
+			}
+			if mapped.Namespace == "" || anchoredRegex(mapped.Namespace).MatchString(endpoint.Namespace) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CollectUnmappedEndpoints sends sa_unmapped_endpoint for every endpoint not mapped to any product.
+func (e *Exporter) CollectUnmappedEndpoints(ch chan<- prometheus.Metric) {
+	unmapped, err := e.GetUnmappedEndpoints()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, endpoint := range unmapped {
+		ch <- prometheus.MustNewConstMetric(
+			metricUnmappedEndpoint, prometheus.GaugeValue, 1.0, endpoint.Namespace, endpoint.Endpoint,
+		)
+	}
+}
+
+// unmappedHandler returns the endpoints not mapped to any product as JSON.
+func unmappedHandler(exporter *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unmapped, err := exporter.GetUnmappedEndpoints()
+		if err != nil {
+			http.Error(w, "Failed to query the endpoints: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(unmapped)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// knownTypes are the service types accepted in the service map, the ones with an aggregation window
+var knownTypes = []string{"batch", "interactive"}
+
+// serviceMapError lists all the problems found in a service map file.
+type serviceMapError struct {
+	filename string
+	errs     []error
+}
+
+func (e *serviceMapError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.filename)
+	sb.WriteString(" is not valid:")
+	for _, err := range e.errs {
+		sb.WriteString("\n  - ")
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// validateServices checks the content of a service map and returns all the problems found.
+func validateServices(jsonServices []services, types []string) []error {
+	var errs []error
+	defined := make(map[string]int)
+	overallDefined := make(map[string]int)
+	for i, service := range jsonServices {
+		entry := fmt.Sprintf("entry %d (product %q type %q)", i, service.Product, service.Type)
+		if service.Product == "" {
+			errs = append(errs, fmt.Errorf("%s: product is empty", entry))
+		}
+		if !containsString(types, service.Type) {
+			errs = append(errs, fmt.Errorf("%s: unknown type %q, expected one of %s", entry, service.Type, strings.Join(types, ", ")))
+		}
+		if first, ok := defined[service.Product+"/"+service.Type]; ok {
+			errs = append(errs, fmt.Errorf("%s: duplicate of entry %d", entry, first))
+		} else {
+			defined[service.Product+"/"+service.Type] = i
+		}
+		errs = append(errs, validateScope(entry, service.serviceScope)...)
+		errs = append(errs, validateThreshold(entry, service.readyThreshold)...)
+		errs = append(errs, validateSource(entry, service.Source)...)
+		errs = append(errs, validateExpression(entry, service.Source, service.Expression)...)
+		errs = append(errs, validateAggregation(entry+" aggregation", service.Aggregation)...)
+		errs = append(errs, validateAggregation(entry+" overall_aggregation", service.OverallAggregation)...)
+		if service.OverallAggregation.Strategy != "" {
+			if first, ok := overallDefined[service.Product]; ok && jsonServices[first].OverallAggregation != service.OverallAggregation {
+				errs = append(errs, fmt.Errorf("%s: overall_aggregation differs from the one of entry %d", entry, first))
+			} else if !ok {
+				overallDefined[service.Product] = i
+			}
+		}
+		for _, dependency := range service.DependsOn {
+			if dependency.Product == service.Product {
+				errs = append(errs, fmt.Errorf("%s: depends on itself", entry))
+			}
+		}
+		if service.Weight < 0 {
+			errs = append(errs, fmt.Errorf("%s: weight %g is negative", entry, service.Weight))
+		}
+
+		if len(service.Endpoints) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no endpoints", entry))
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Name == "" {
+				errs = append(errs, fmt.Errorf("%s: endpoint name is empty", entry))
+				continue
+			}
+			if _, err := regexp.Compile(endpoint.Name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: endpoint %q is not a valid regex: %v", entry, endpoint.Name, err))
+			}
+			errs = append(errs, validateScope(entry+" endpoint "+endpoint.Name, endpoint.serviceScope)...)
+			errs = append(errs, validateThreshold(entry+" endpoint "+endpoint.Name, endpoint.readyThreshold)...)
+			errs = append(errs, validateProbe(entry+" endpoint "+endpoint.Name, endpoint.Probe)...)
+			errs = append(errs, validateSource(entry+" endpoint "+endpoint.Name, endpoint.Source)...)
+			errs = append(errs, validateExpression(entry+" endpoint "+endpoint.Name, endpoint.Source, endpoint.Expression)...)
+			if inheritedString(endpoint.Source, service.Source) == sourcePromQL && inheritedString(endpoint.Expression, service.Expression) == "" {
+				errs = append(errs, fmt.Errorf("%s endpoint %s: source %s needs an expression", entry, endpoint.Name, sourcePromQL))
+			}
+			if endpoint.Weight < 0 {
+				errs = append(errs, fmt.Errorf("%s endpoint %s: weight %g is negative", entry, endpoint.Name, endpoint.Weight))
+			}
+		}
+	}
+	return errs
+}
+
+// validateScope checks that the namespace and cluster selectors are valid regex.
+func validateScope(kind string, scope serviceScope) []error {
+	var errs []error
+	if _, err := regexp.Compile(scope.Namespace); err != nil {
+		errs = append(errs, fmt.Errorf("%s: namespace %q is not a valid regex: %v", kind, scope.Namespace, err))
+	}
+	if _, err := regexp.Compile(scope.Cluster); err != nil {
+		errs = append(errs, fmt.Errorf("%s: cluster %q is not a valid regex: %v", kind, scope.Cluster, err))
+	}
+	return errs
+}
+
+// validateThreshold checks that the minimum ready count is positive and the minimum ready ratio a fraction.
+func validateThreshold(kind string, threshold readyThreshold) []error {
+	var errs []error
+	if threshold.MinReady < 0 {
+		errs = append(errs, fmt.Errorf("%s: min_ready %d is negative", kind, threshold.MinReady))
+	}
+	if threshold.MinReadyRatio < 0 || threshold.MinReadyRatio > 1 {
+		errs = append(errs, fmt.Errorf("%s: min_ready_ratio %g is not between 0 and 1", kind, threshold.MinReadyRatio))
+	}
+	return errs
+}
+
+// validateSource checks that the source of the endpoints is known.
+func validateSource(kind string, source string) []error {
+	if source != "" && !containsString(serviceSources, source) {
+		return []error{fmt.Errorf("%s: unknown source %q, expected one of %s", kind, source, strings.Join(serviceSources, ", "))}
+	}
+	return nil
+}
+
+// validateExpression checks that an expression is only set for the promql source and only uses known placeholders.
+func validateExpression(kind string, source string, expression string) []error {
+	var errs []error
+	if expression != "" && source != "" && source != sourcePromQL {
+		errs = append(errs, fmt.Errorf("%s: expression is only used by the %s source, not %s", kind, sourcePromQL, source))
+	}
+	for _, match := range expressionPlaceholder.FindAllStringSubmatch(expression, -1) {
+		if !containsString(expressionPlaceholders, match[1]) {
+			errs = append(errs, fmt.Errorf("%s: unknown placeholder %s in expression, expected one of %s", kind, match[0], strings.Join(expressionPlaceholders, ", ")))
+		}
+	}
+	return errs
+}
+
+// inheritedString returns the value of an endpoint field, the one of its entry if not set.
+func inheritedString(value string, entryValue string) string {
+	if value == "" {
+		return entryValue
+	}
+	return value
+}
+
+// validateAggregation checks that the strategy is known and has the parameters it needs.
+func validateAggregation(kind string, config aggregationConfig) []error {
+	if config == (aggregationConfig{}) {
+		return nil
+	}
+	if !containsString(aggregationStrategies, config.Strategy) {
+		return []error{fmt.Errorf("%s: unknown strategy %q, expected one of %s", kind, config.Strategy, strings.Join(aggregationStrategies, ", "))}
+	}
+	var errs []error
+	if config.Strategy == strategyQuorum && config.Quorum < 1 {
+		errs = append(errs, fmt.Errorf("%s: quorum must be at least 1", kind))
+	}
+	if config.Strategy == strategyPercentageUp && (config.Percentage <= 0 || config.Percentage > 100) {
+		errs = append(errs, fmt.Errorf("%s: percentage %g is not between 0 and 100", kind, config.Percentage))
+	}
+	if config.Threshold != 0 && config.Strategy != strategyWeightedAverage {
+		errs = append(errs, fmt.Errorf("%s: threshold is only used by the %s strategy", kind, strategyWeightedAverage))
+	}
+	if config.Threshold < 0 || config.Threshold > 1 {
+		errs = append(errs, fmt.Errorf("%s: threshold %g is not between 0 and 1", kind, config.Threshold))
+	}
+	return errs
+}
+
+// validateDependencies checks that the products depended on are defined in the service map
+// and that the dependencies do not form a cycle.
+func validateDependencies(jsonServices []services) []error {
+	var errs []error
+	graph := dependencyGraph(jsonServices)
+	for _, product := range sortedProducts(graph) {
+		for _, dependency := range graph[product] {
+			if _, ok := graph[dependency.Product]; !ok {
+				errs = append(errs, fmt.Errorf("product %q depends on the unknown product %q", product, dependency.Product))
+			}
+		}
+	}
+	if cycle := findDependencyCycle(graph); cycle != nil {
+		errs = append(errs, fmt.Errorf("dependency cycle %s", strings.Join(cycle, " -> ")))
+	}
+	return errs
+}
+
+// validateProbe checks that a probe has one module with a valid configuration.
+func validateProbe(kind string, probe *probeConfig) []error {
+	if probe == nil {
+		return nil
+	}
+	var errs []error
+	modules := 0
+	for _, set := range []bool{probe.HTTP != nil, probe.TCP != nil, probe.GRPC != nil} {
+		if set {
+			modules++
+		}
+	}
+	if modules != 1 {
+		errs = append(errs, fmt.Errorf("%s: probe has %d modules, expected one of http, tcp or grpc", kind, modules))
+	}
+	if probe.Combine != "" && !containsString(probeCombines, probe.Combine) {
+		errs = append(errs, fmt.Errorf("%s: unknown probe combine %q, expected one of %s", kind, probe.Combine, strings.Join(probeCombines, ", ")))
+	}
+	if probe.Timeout != "" {
+		if _, err := model.ParseDuration(probe.Timeout); err != nil {
+			errs = append(errs, fmt.Errorf("%s: probe timeout %q is not valid: %v", kind, probe.Timeout, err))
+		}
+	}
+	if probe.HTTP != nil {
+		if u, err := url.Parse(probe.HTTP.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: probe url %q is not a valid http or https URL", kind, probe.HTTP.URL))
+		}
+		if _, err := regexp.Compile(probe.HTTP.BodyRegex); err != nil {
+			errs = append(errs, fmt.Errorf("%s: probe body_regex %q is not a valid regex: %v", kind, probe.HTTP.BodyRegex, err))
+		}
+		for _, code := range probe.HTTP.StatusCodes {
+			if code < 100 || code > 599 {
+				errs = append(errs, fmt.Errorf("%s: probe status code %d is not valid", kind, code))
+			}
+		}
+	}
+	if probe.TCP != nil {
+		if _, _, err := net.SplitHostPort(probe.TCP.Address); err != nil {
+			errs = append(errs, fmt.Errorf("%s: probe tcp address %q is not valid: %v", kind, probe.TCP.Address, err))
+		}
+	}
+	if probe.GRPC != nil {
+		if _, _, err := net.SplitHostPort(probe.GRPC.Address); err != nil {
+			errs = append(errs, fmt.Errorf("%s: probe grpc address %q is not valid: %v", kind, probe.GRPC.Address, err))
+		}
+	}
+	return errs
+}
+
+// validateCommand implements "sa-exporter validate <file>...", it returns the exit code of the process.
+func validateCommand(filenames []string) int {
+	if len(filenames) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: sa-exporter validate <file>...")
+		return 2
+	}
+	typesAggr, err := loadTypesAggr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	knownTypes = sortedTypes(typesAggr)
+
+	exitCode := 0
+	var files []serviceMapFile
+	for _, filename := range filenames {
+		jsonServices, err := loadServices(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+			continue
+		}
+		files = append(files, serviceMapFile{filename, jsonServices})
+		fmt.Println(filename, "is valid")
+	}
+	//the conflicts and dependencies are checked on the files merged like the exporter does, the products may be defined in any of them
+	if exitCode == 0 {
+		merged, conflicts := mergeServices(files)
+		if errs := append(conflicts, validateDependencies(merged)...); len(errs) > 0 {
+			fmt.Fprintln(os.Stderr, &serviceMapError{filename: "the service map", errs: errs})
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,51 @@
+package main
+
+// Workload kinds of kube-state-metrics usable as sources, for workers without a Service.
+const (
+	sourceDeployment  = "deployment"
+	sourceStatefulSet = "statefulset"
+	sourceDaemonSet   = "daemonset"
+)
+
+// workloadMetrics are the kube-state-metrics series giving the ready and desired replicas of a workload kind,
+// the workload name being in the label named after the kind.
+type workloadMetrics struct {
+	ready   string
+	desired string
+}
+
+// workloadKinds are the metrics of every workload kind.
+var workloadKinds = map[string]workloadMetrics{
+	sourceDeployment:  {ready: "kube_deployment_status_replicas_available", desired: "kube_deployment_spec_replicas"},
+	sourceStatefulSet: {ready: "kube_statefulset_status_replicas_ready", desired: "kube_statefulset_replicas"},
+	sourceDaemonSet:   {ready: "kube_daemonset_status_number_ready", desired: "kube_daemonset_status_desired_number_scheduled"},
+}
+
+// GetMetricSaWorkloadScope retrieves service availability metrics from the ready and desired replicas of the workloads
+// of a kind for the endpoints of a type sharing the same scope, the endpoints matching the workload names.
+func (e *Exporter) GetMetricSaWorkloadScope(kind string, typeEndpoint string, aggr string, scope serviceScope, endpoints []serviceEndpoint) []ProductTypeEndpointValue {
+	//1. find the desired and ready replicas, like an address the max over the window keeps the replicas seen ready at least once
+	metrics := workloadKinds[kind]
+	selector := BuildSelector(kind, scope, endpoints)
+	desired, err := e.QueryEndpointValues(kind, BuildWorkloadQuery(kind, metrics.desired, selector, aggr))
+	if err != nil {
+		return nil
+	}
+	ready, err := e.QueryEndpointValues(kind, BuildWorkloadQuery(kind, metrics.ready, selector, aggr))
+	if err != nil {
+		return nil
+	}
+	replicas := make(map[string]endpointAddresses)
+	for workload, count := range desired {
+		replicas[workload] = endpointAddresses{Ready: ready[workload], Total: count}
+	}
+
+	//2. apply the ready threshold of the endpoints to the ready replicas, a workload without series being missing
+	return e.AddressesValues(typeEndpoint, scope, endpoints, kind, replicas, "no "+metrics.desired+" series")
+}
+
+// BuildWorkloadQuery builds the PromQL query summing by workload name the series of metric matching selector,
+// each one being first reduced over the aggr lookback window.
+func BuildWorkloadQuery(kind string, metric string, selector string, aggr string) string {
+	return "sum by (" + kind + ")(" + overWindow(metric+"{"+selector+"}", aggr) + ")"
+}